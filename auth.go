@@ -9,13 +9,18 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/pkg/errors"
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 func getTLSConfig(ctx context.Context, req *logical.Request, configCa *CAGWConfigRole) (*tls.Config, error) {
-	certificate, err := tls.X509KeyPair([]byte(configCa.PEMBundle), []byte(configCa.PEMBundle))
+	certificate, err := getClientCertificate(&configCa.CAGWConnection)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error parsing client certificate and key")
 	}
@@ -29,14 +34,94 @@ func getTLSConfig(ctx context.Context, req *logical.Request, configCa *CAGWConfi
 		return nil, errors.New("Error appending CA certs.")
 	}
 
+	minVersion, err := configCa.tlsMinVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	cipherSuites, err := configCa.cipherSuites()
+	if err != nil {
+		return nil, err
+	}
+
 	tlsClientConfig := tls.Config{
 		Certificates: []tls.Certificate{
 			certificate,
 		},
-		RootCAs: certPool,
+		RootCAs:      certPool,
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+		ServerName:   configCa.TLSServerName,
 	}
 
 	tlsClientConfig.BuildNameToCertificate()
 
 	return &tlsClientConfig, nil
 }
+
+// getClientCertificate loads the client credentials of a gateway connection.
+// The credentials are either a base64 encoded PKCS#12 or a PEM bundle whose
+// private key may be an encrypted PKCS#8 key. Both are normalised to PEM and
+// loaded with tls.X509KeyPair, which also verifies that the key matches the
+// certificate.
+func getClientCertificate(configCa *CAGWConnection) (tls.Certificate, error) {
+	if len(configCa.PKCS12) > 0 {
+		p12, err := base64.StdEncoding.DecodeString(configCa.PKCS12)
+		if err != nil {
+			return tls.Certificate{}, errors.Wrap(err, "PKCS#12 could not be base64 decoded")
+		}
+
+		privateKey, certificate, caCerts, err := pkcs12.DecodeChain(p12, configCa.PKCS12Password)
+		if err != nil {
+			return tls.Certificate{}, errors.Wrap(err, "PKCS#12 could not be decoded")
+		}
+
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			return tls.Certificate{}, errors.Wrap(err, "PKCS#12 private key could not be encoded")
+		}
+
+		certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+		for _, c := range caCerts {
+			certPem = append(certPem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+		}
+		keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+
+		return tls.X509KeyPair(certPem, keyPem)
+	}
+
+	var certPem []byte
+	var keyPem []byte
+	rest := []byte(configCa.PEMBundle)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			certPem = append(certPem, pem.EncodeToMemory(block)...)
+		case "ENCRYPTED PRIVATE KEY":
+			if len(configCa.KeyPassword) == 0 {
+				return tls.Certificate{}, errors.New("the private key is encrypted but no key password was provided")
+			}
+			privateKey, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(configCa.KeyPassword))
+			if err != nil {
+				return tls.Certificate{}, errors.Wrap(err, "encrypted private key could not be decrypted")
+			}
+			keyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+			if err != nil {
+				return tls.Certificate{}, errors.Wrap(err, "decrypted private key could not be encoded")
+			}
+			keyPem = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+		default:
+			if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+				keyPem = pem.EncodeToMemory(block)
+			}
+		}
+	}
+
+	return tls.X509KeyPair(certPem, keyPem)
+}
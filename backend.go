@@ -8,8 +8,10 @@ package main
 import (
 	"context"
 
+	"github.com/hashicorp/vault/helper/consts"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
 )
 
 // Factory returns a new backend as logical.Backend.
@@ -18,6 +20,9 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 	if err := b.Setup(ctx, conf); err != nil {
 		return nil, err
 	}
+	if err := b.migrateStorage(ctx, conf.StorageView); err != nil {
+		return nil, errors.Wrap(err, "storage migration failed")
+	}
 	return b, nil
 }
 
@@ -32,14 +37,21 @@ func Backend(conf *logical.BackendConfig) *backend {
 			pathIssue(&b),
 			pathConfigProfiles(&b),
 			pathConfigProfile(&b),
+			pathConfigDiagnose(&b),
+			pathConfigRefresh(&b),
+			pathConnections(&b),
+			pathConnection(&b),
+			pathExport(&b),
+			pathImport(&b),
 		},
 		PathsSpecial: &logical.Paths{
 			Unauthenticated: []string{
 				"ca",
 			},
 		},
-		Secrets:     []*framework.Secret{},
-		BackendType: logical.TypeLogical,
+		Secrets:      []*framework.Secret{},
+		BackendType:  logical.TypeLogical,
+		PeriodicFunc: b.periodicRefreshProfiles,
 	}
 	return &b
 }
@@ -47,3 +59,14 @@ func Backend(conf *logical.BackendConfig) *backend {
 type backend struct {
 	*framework.Backend
 }
+
+// writesStorage tells whether this node writes to the storage of the mount on
+// its own. Performance standbys and replication secondaries, unless the mount
+// is local, leave background writes to the active node of the primary.
+func (b *backend) writesStorage() bool {
+	replicationState := b.System().ReplicationState()
+	if replicationState.HasState(consts.ReplicationDRSecondary | consts.ReplicationPerformanceStandby) {
+		return false
+	}
+	return b.System().LocalMount() || !replicationState.HasState(consts.ReplicationPerformanceSecondary)
+}
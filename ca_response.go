@@ -0,0 +1,17 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+type CertificateAuthorityResponse struct {
+	CertificateAuthority CertificateAuthority `json:"certificateAuthority"`
+	Message              Message              `json:"message"`
+}
+
+type CertificateAuthority struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
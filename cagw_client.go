@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// gatewayEndpoints remembers which gateway endpoints failed recently. It is
+// shared by all roles and connections, as the health of an endpoint does not
+// depend on who calls it.
+var gatewayEndpoints = &endpointHealth{downUntil: map[string]time.Time{}}
+
+type endpointHealth struct {
+	sync.Mutex
+	downUntil map[string]time.Time
+}
+
+func (h *endpointHealth) markDown(endpoint string, cooldown time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+	h.downUntil[endpoint] = time.Now().Add(cooldown)
+}
+
+func (h *endpointHealth) markUp(endpoint string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.downUntil, endpoint)
+}
+
+// order returns the endpoints that are not cooling down followed by the ones
+// that are, so a request is still attempted when every endpoint failed
+// recently.
+func (h *endpointHealth) order(endpoints []string) []string {
+	h.Lock()
+	defer h.Unlock()
+
+	var up, down []string
+	now := time.Now()
+	for _, endpoint := range endpoints {
+		if until, ok := h.downUntil[endpoint]; ok && now.Before(until) {
+			down = append(down, endpoint)
+		} else {
+			up = append(up, endpoint)
+		}
+	}
+	return append(up, down...)
+}
+
+// gatewayResponse is a response read from CAGW together with the endpoint
+// that served it.
+type gatewayResponse struct {
+	StatusCode int
+	Body       []byte
+	Endpoint   string
+}
+
+// request sends a request to the gateway endpoints of the connection in turn
+// until one of them answers. Idempotent requests fail over on connection
+// errors and 5xx responses, marking the endpoint as down for the failover
+// cool-down; the 5xx response of the last endpoint is returned as is. Other
+// requests, like enrollments, only fail over when the request could not be
+// sent at all, so that a certificate is never issued twice; they never fail
+// over on 5xx responses. Cancelling the context stops the failover.
+func (c *CAGWConnection) request(ctx context.Context, client *http.Client, method string, path string, body []byte) (*gatewayResponse, error) {
+	endpoints := gatewayEndpoints.order(c.endpoints())
+	if len(endpoints) == 0 {
+		return nil, errors.New("no gateway URL configured")
+	}
+	cooldown := durationOrDefault(c.FailoverCooldown, defaultFailoverCooldown)
+	idempotent := method == http.MethodGet || method == http.MethodHead
+
+	var failures []string
+	for i, endpoint := range endpoints {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Wrap(err, "gateway request cancelled")
+		}
+
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+		// The request is known not to have been sent as long as the
+		// transport has not finished writing it
+		var written int32
+		trace := &httptrace.ClientTrace{
+			WroteRequest: func(info httptrace.WroteRequestInfo) {
+				if info.Err == nil {
+					atomic.StoreInt32(&written, 1)
+				}
+			},
+		}
+		httpReq, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), method, strings.TrimSuffix(endpoint, "/")+path, reqBody)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			httpReq.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := client.Do(httpReq)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, errors.Wrap(ctx.Err(), "gateway request cancelled")
+			}
+			gatewayEndpoints.markDown(endpoint, cooldown)
+			if !idempotent && atomic.LoadInt32(&written) == 1 && !requestNotSent(err) {
+				return nil, errors.Wrapf(err, "%s: the request may have been processed and is not sent to another endpoint", endpoint)
+			}
+			failures = append(failures, fmt.Sprintf("%s: %s", endpoint, err))
+			continue
+		}
+
+		responseBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			gatewayEndpoints.markDown(endpoint, cooldown)
+			if !idempotent {
+				return nil, errors.Wrapf(err, "%s: CAGW response could not be read", endpoint)
+			}
+			failures = append(failures, fmt.Sprintf("%s: CAGW response could not be read: %s", endpoint, err))
+			continue
+		}
+
+		if resp.StatusCode >= 500 {
+			gatewayEndpoints.markDown(endpoint, cooldown)
+			if idempotent && i < len(endpoints)-1 {
+				failures = append(failures, fmt.Sprintf("%s: response code %d", endpoint, resp.StatusCode))
+				continue
+			}
+		} else {
+			gatewayEndpoints.markUp(endpoint)
+		}
+
+		return &gatewayResponse{
+			StatusCode: resp.StatusCode,
+			Body:       responseBody,
+			Endpoint:   endpoint,
+		}, nil
+	}
+
+	return nil, errors.New("no gateway endpoint could be reached: " + strings.Join(failures, "; "))
+}
+
+// requestNotSent tells whether a client error happened before any part of the
+// request reached the gateway: the name could not be resolved, the connection
+// to the gateway, or to the proxy, could not be opened or the TLS handshake
+// failed.
+func requestNotSent(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			// TLS alerts sent by the gateway during the handshake
+			return e.Op == "dial" || e.Op == "proxyconnect" || e.Op == "remote error"
+		case *net.DNSError:
+			return true
+		case tls.RecordHeaderError, x509.CertificateInvalidError, x509.HostnameError,
+			x509.UnknownAuthorityError, x509.SystemRootsError, x509.ConstraintViolationError:
+			return true
+		default:
+			// The error type of the handshake timeout is not exported
+			if err.Error() == "net/http: TLS handshake timeout" {
+				return true
+			}
+			// Newer Go versions wrap the certificate verification errors
+			wrapper, ok := err.(interface{ Unwrap() error })
+			if !ok {
+				return false
+			}
+			err = wrapper.Unwrap()
+		}
+	}
+	return false
+}
@@ -10,25 +10,28 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"github.com/pkg/errors"
 )
 
 type CAGWConfigRole struct {
-	PEMBundle string
-	URL       string
-	CACerts   string
-	CAId      string
-	ProfileId string
+	CAGWConnection
+	Connection      string   `json:"connection"`
+	CAId            string   `json:"ca_id"`
+	ProfileId       string   `json:"profile_id"`
+	AllowedProfiles []string `json:"allowed_profiles"`
+	DefaultProfile  string   `json:"default_profile"`
+	ResponseMode    string   `json:"response_mode"`
 }
 
 type CAGWConfigCAConfigProfileIDs struct {
+	SchemaVersion int `json:"schema_version"`
 	CAGWConfigRole
-	Profiles []CAGWConfigProfileID
+	Profiles []CAGWConfigProfileID `json:"profiles"`
 }
 
 func (c CAGWConfigRole) ProfileIDs(ctx context.Context, req *logical.Request, data *framework.FieldData, caId string) ([]CAGWConfigProfileID, error) {
@@ -42,7 +45,7 @@ func (c CAGWConfigRole) ProfileIDs(ctx context.Context, req *logical.Request, da
 		return nil, fmt.Errorf("Error retrieving TLS configuration: %w", err)
 	}
 
-	profilesResp, err := c.getProfiles(tlsClientConfig, caId)
+	profilesResp, err := c.getProfiles(ctx, tlsClientConfig, caId)
 	if err != nil {
 		return nil, fmt.Errorf("Error response received from gateway: %w", err)
 	}
@@ -60,23 +63,48 @@ func (c CAGWConfigRole) ProfileIDs(ctx context.Context, req *logical.Request, da
 
 }
 
-func (c CAGWConfigRole) getProfiles(tlsClientConfig *tls.Config, caId string) (*ProfilesResponse, error) {
-	tr := &http.Transport{
-		Proxy:           http.ProxyFromEnvironment,
-		TLSClientConfig: tlsClientConfig,
+// profileIdFor returns the profile to use for a request that asked for the
+// given profile, which may be empty. A role bound to a single profile always
+// uses that profile; otherwise the requested or default profile is used and
+// must match the role's allowed profiles, if any.
+func (c CAGWConfigRole) profileIdFor(requested string) (string, error) {
+	if len(c.ProfileId) > 0 {
+		return c.ProfileId, nil
 	}
 
-	client := &http.Client{Transport: tr}
+	profileId := requested
+	if len(profileId) <= 0 {
+		profileId = c.DefaultProfile
+		if len(profileId) <= 0 {
+			return "", errors.New("a profile must be specified for this CA role configuration")
+		}
+	}
+
+	if !c.profileAllowed(profileId) {
+		return "", errors.Errorf("profile %s is not allowed for this CA role configuration", profileId)
+	}
+
+	return profileId, nil
+}
+
+func (c CAGWConfigRole) profileAllowed(profileId string) bool {
+	if len(c.AllowedProfiles) == 0 {
+		return true
+	}
+	return strutil.StrListContainsGlob(c.AllowedProfiles, profileId)
+}
 
-	resp, err := client.Get(c.URL + "/v1/certificate-authorities/" + caId + "/profiles")
+func (c CAGWConfigRole) getProfiles(ctx context.Context, tlsClientConfig *tls.Config, caId string) (*ProfilesResponse, error) {
+	client, err := c.httpClient(tlsClientConfig)
 	if err != nil {
-		return nil, fmt.Errorf("Error response: %w", err)
+		return nil, err
 	}
 
-	responseBody, err := ioutil.ReadAll(resp.Body)
+	resp, err := c.request(ctx, client, http.MethodGet, "/v1/certificate-authorities/"+caId+"/profiles", nil)
 	if err != nil {
-		return nil, fmt.Errorf("CAGW response could not be read: %w", err)
+		return nil, fmt.Errorf("Error response: %w", err)
 	}
+	responseBody := resp.Body
 
 	if resp.StatusCode != 200 {
 		var errorResponse *ErrorResponse
@@ -95,3 +123,33 @@ func (c CAGWConfigRole) getProfiles(tlsClientConfig *tls.Config, caId string) (*
 
 	return profilesResp, nil
 }
+
+func (c CAGWConfigRole) getCertificateAuthority(ctx context.Context, tlsClientConfig *tls.Config, caId string) (*CertificateAuthorityResponse, error) {
+	client, err := c.httpClient(tlsClientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.request(ctx, client, http.MethodGet, "/v1/certificate-authorities/"+caId, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error response: %w", err)
+	}
+	responseBody := resp.Body
+
+	if resp.StatusCode != 200 {
+		var errorResponse *ErrorResponse
+		err := json.Unmarshal(responseBody, &errorResponse)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("CAGW error response could not be parsed (%d)", resp.StatusCode))
+		}
+		return nil, errors.New(fmt.Sprintf("Error from gateway: %s (%d)", errorResponse.Error.Message, resp.StatusCode))
+	}
+
+	var caResp *CertificateAuthorityResponse
+	err = json.Unmarshal(responseBody, &caResp)
+	if err != nil {
+		return nil, fmt.Errorf("CAGW certificate authority response could not be parsed: %w", err)
+	}
+
+	return caResp, nil
+}
@@ -7,46 +7,99 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"github.com/pkg/errors"
 )
 
 type CAGWConfigProfile struct {
+	SchemaVersion               int                          `json:"schema_version"`
 	Id                          string                       `json:"id"`
 	Name                        string                       `json:"name"`
 	SubjectVariableRequirements []SubjectVariableRequirement `json:"subjectVariableRequirements"`
 	SubjectAltNameRequirements  []SubjectAltNameRequirement  `json:"subjectAltNameRequirements"`
 	TTL                         time.Duration                `json:"ttl_duration" mapstructure:"ttl_duration"`
 	MaxTTL                      time.Duration                `json:"max_ttl_duration" mapstructure:"max_ttl_duration"`
+	RefreshInterval             time.Duration                `json:"refresh_interval_duration" mapstructure:"refresh_interval_duration"`
+	LastRefreshed               time.Time                    `json:"last_refreshed" mapstructure:"last_refreshed"`
+	AllowedKeyTypes             []string                     `json:"allowed_key_types" mapstructure:"allowed_key_types"`
+	CommonNameVariable          string                       `json:"common_name_variable" mapstructure:"common_name_variable"`
+	SANTypes                    map[string]string            `json:"san_types" mapstructure:"san_types"`
+	UseCSRValues                bool                         `json:"use_csr_values" mapstructure:"use_csr_values"`
+	MinRSABits                  int                          `json:"min_rsa_bits" mapstructure:"min_rsa_bits"`
+	AllowedECCurves             []string                     `json:"allowed_ec_curves" mapstructure:"allowed_ec_curves"`
+	AllowedSignatureAlgorithms  []string                     `json:"allowed_signature_algorithms" mapstructure:"allowed_signature_algorithms"`
+	AllowedDomains              []string                     `json:"allowed_domains" mapstructure:"allowed_domains"`
+	AllowSubdomains             bool                         `json:"allow_subdomains" mapstructure:"allow_subdomains"`
+	AllowGlobDomains            bool                         `json:"allow_glob_domains" mapstructure:"allow_glob_domains"`
+	AllowBareDomains            bool                         `json:"allow_bare_domains" mapstructure:"allow_bare_domains"`
+	AllowWildcardCertificates   bool                         `json:"allow_wildcard_certificates" mapstructure:"allow_wildcard_certificates"`
+	AllowedIPCIDRs              []string                     `json:"allowed_ip_cidrs" mapstructure:"allowed_ip_cidrs"`
+	AllowedURISANs              []string                     `json:"allowed_uri_sans" mapstructure:"allowed_uri_sans"`
+	AllowedEmailDomains         []string                     `json:"allowed_email_domains" mapstructure:"allowed_email_domains"`
+	DefaultSubjectVariables     string                       `json:"default_subject_variables" mapstructure:"default_subject_variables"`
+	FixedSubjectVariables       string                       `json:"fixed_subject_variables" mapstructure:"fixed_subject_variables"`
+	DefaultAltNames             []string                     `json:"default_alt_names" mapstructure:"default_alt_names"`
+	FixedAltNames               []string                     `json:"fixed_alt_names" mapstructure:"fixed_alt_names"`
+	EntityBoundNames            []string                     `json:"entity_bound_names" mapstructure:"entity_bound_names"`
+	EntityBoundSubdomains       bool                         `json:"entity_bound_subdomains" mapstructure:"entity_bound_subdomains"`
+	AllowedEnrollmentOptions    []string                     `json:"allowed_enrollment_options" mapstructure:"allowed_enrollment_options"`
+	FixedEnrollmentOptions      map[string]string            `json:"fixed_enrollment_options" mapstructure:"fixed_enrollment_options"`
 }
 
+// Kinds of SANs in Vault PKI style requests, mapped to CAGW SAN types by the
+// san_types of a profile.
+const (
+	sanKindDNS   = "dns"
+	sanKindEmail = "email"
+	sanKindIP    = "ip"
+	sanKindURI   = "uri"
+	sanKindOther = "other"
+)
+
+var defaultSANTypes = map[string]string{
+	sanKindDNS:   "dNSName",
+	sanKindEmail: "rfc822Name",
+	sanKindIP:    "iPAddress",
+	sanKindURI:   "uniformResourceIdentifier",
+	sanKindOther: "otherName",
+}
+
+const defaultCommonNameVariable = "cn"
+
+// defaultMinRSABits is the minimum RSA key size of profiles that do not set
+// one.
+const defaultMinRSABits = 2048
+
 type CAGWConfigProfileID struct {
-	Id   string
-	Name string
+	Id   string `json:"id"`
+	Name string `json:"name"`
 }
 
 func (p CAGWConfigProfileID) Profile(ctx context.Context, req *logical.Request, data *framework.FieldData) (*CAGWConfigProfile, error) {
 
 	roleName := data.Get("roleName").(string)
 	configRole, err := getConfigRole(ctx, req, roleName)
-
-	if len(p.Id) <= 0 {
-		p.Id = configRole.ProfileId
-		if len(p.Id) <= 0 {
-			return nil, errors.New("Missing the profile ID")
-		}
+	if err != nil {
+		return nil, errors.New("Error fetching config")
 	}
 
+	p.Id, err = configRole.profileIdFor(p.Id)
 	if err != nil {
-		return nil, errors.New("Error fetching config")
+		return nil, err
 	}
 
 	tlsClientConfig, err := getTLSConfig(ctx, req, configRole)
@@ -54,7 +107,7 @@ func (p CAGWConfigProfileID) Profile(ctx context.Context, req *logical.Request,
 		return nil, fmt.Errorf("Error retrieving TLS configuration: %w", err)
 	}
 
-	profileResp, err := p.getProfile(tlsClientConfig, configRole, roleName)
+	profileResp, err := p.getProfile(ctx, tlsClientConfig, configRole, roleName)
 
 	if err != nil {
 		return nil, fmt.Errorf("Error response received from gateway: %w", err)
@@ -62,41 +115,61 @@ func (p CAGWConfigProfileID) Profile(ctx context.Context, req *logical.Request,
 
 	ttl := time.Duration(data.Get("ttl").(int)) * time.Second
 	maxTtl := time.Duration(data.Get("max_ttl").(int)) * time.Second
+	refreshInterval := time.Duration(data.Get("refresh_interval").(int)) * time.Second
 
 	profile := &CAGWConfigProfile{
-		profileResp.Profile.Id,
-		profileResp.Profile.Name,
-		profileResp.Profile.SubjectVariableRequirements,
-		profileResp.Profile.SubjectAltNameRequirements,
-		ttl,
-		maxTtl,
+		Id:                          profileResp.Profile.Id,
+		Name:                        profileResp.Profile.Name,
+		SubjectVariableRequirements: profileResp.Profile.SubjectVariableRequirements,
+		SubjectAltNameRequirements:  profileResp.Profile.SubjectAltNameRequirements,
+		TTL:                         ttl,
+		MaxTTL:                      maxTtl,
+		RefreshInterval:             refreshInterval,
+		LastRefreshed:               time.Now(),
+		AllowedKeyTypes:             data.Get("allowed_key_types").([]string),
+		CommonNameVariable:          data.Get("common_name_variable").(string),
+		SANTypes:                    data.Get("san_types").(map[string]string),
+		UseCSRValues:                data.Get("use_csr_values").(bool),
+		MinRSABits:                  data.Get("min_rsa_bits").(int),
+		AllowedECCurves:             data.Get("allowed_ec_curves").([]string),
+		AllowedSignatureAlgorithms:  data.Get("allowed_signature_algorithms").([]string),
+		AllowedDomains:              data.Get("allowed_domains").([]string),
+		AllowSubdomains:             data.Get("allow_subdomains").(bool),
+		AllowGlobDomains:            data.Get("allow_glob_domains").(bool),
+		AllowBareDomains:            data.Get("allow_bare_domains").(bool),
+		AllowWildcardCertificates:   data.Get("allow_wildcard_certificates").(bool),
+		AllowedIPCIDRs:              data.Get("allowed_ip_cidrs").([]string),
+		AllowedURISANs:              data.Get("allowed_uri_sans").([]string),
+		AllowedEmailDomains:         data.Get("allowed_email_domains").([]string),
+		DefaultSubjectVariables:     data.Get("default_subject_variables").(string),
+		FixedSubjectVariables:       data.Get("fixed_subject_variables").(string),
+		DefaultAltNames:             data.Get("default_alt_names").([]string),
+		FixedAltNames:               data.Get("fixed_alt_names").([]string),
+		EntityBoundNames:            data.Get("entity_bound_names").([]string),
+		EntityBoundSubdomains:       data.Get("entity_bound_subdomains").(bool),
+		AllowedEnrollmentOptions:    data.Get("allowed_enrollment_options").([]string),
+		FixedEnrollmentOptions:      data.Get("fixed_enrollment_options").(map[string]string),
 	}
 
 	return profile, nil
 
 }
 
-func (p CAGWConfigProfileID) getProfile(tlsClientConfig *tls.Config, configRole *CAGWConfigRole, roleName string) (*ProfileResponse, error) {
-	tr := &http.Transport{
-		Proxy:           http.ProxyFromEnvironment,
-		TLSClientConfig: tlsClientConfig,
+func (p CAGWConfigProfileID) getProfile(ctx context.Context, tlsClientConfig *tls.Config, configRole *CAGWConfigRole, roleName string) (*ProfileResponse, error) {
+	client, err := configRole.httpClient(tlsClientConfig)
+	if err != nil {
+		return nil, err
 	}
 
-	client := &http.Client{Transport: tr}
-
 	caId := configRole.CAId
 	if len(caId) <= 0 {
 		caId = roleName
 	}
-	resp, err := client.Get(configRole.URL + "/v1/certificate-authorities/" + caId + "/profiles/" + p.Id)
+	resp, err := configRole.request(ctx, client, http.MethodGet, "/v1/certificate-authorities/"+caId+"/profiles/"+p.Id, nil)
 	if err != nil {
 		return nil, fmt.Errorf("Error response: %w", err)
 	}
-
-	responseBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("CAGW response could not be read: %w", err)
-	}
+	responseBody := resp.Body
 
 	if resp.StatusCode != 200 {
 		var errorResponse *ErrorResponse
@@ -115,3 +188,266 @@ func (p CAGWConfigProfileID) getProfile(tlsClientConfig *tls.Config, configRole
 
 	return profileResp, nil
 }
+
+// keyTypeAllowed tells if keys of the given type can be used with the
+// profile. All key types are allowed if the profile does not list any.
+func (p *CAGWConfigProfile) keyTypeAllowed(keyType string) bool {
+	if len(p.AllowedKeyTypes) == 0 {
+		return true
+	}
+	return strutil.StrListContains(p.AllowedKeyTypes, keyType)
+}
+
+// minRSABits returns the minimum RSA key size of the profile. Profiles that
+// do not set one, including the ones stored before the setting had a
+// default, get the default minimum.
+func (p *CAGWConfigProfile) minRSABits() int {
+	if p.MinRSABits <= 0 {
+		return defaultMinRSABits
+	}
+	return p.MinRSABits
+}
+
+// checkPublicKey enforces the key type, the minimum RSA key size and the
+// allowed EC curves of the profile.
+func (p *CAGWConfigProfile) checkPublicKey(publicKey crypto.PublicKey) error {
+	keyType := publicKeyType(publicKey)
+	if !p.keyTypeAllowed(keyType) {
+		return errors.Errorf("key type %s is not allowed for profile %s", keyType, p.Id)
+	}
+
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		if minRSABits := p.minRSABits(); k.N.BitLen() < minRSABits {
+			return errors.Errorf("RSA key size %d is below the minimum of %d bits for profile %s", k.N.BitLen(), minRSABits, p.Id)
+		}
+	case *ecdsa.PublicKey:
+		curve := k.Curve.Params().Name
+		if len(p.AllowedECCurves) > 0 && !strutil.StrListContains(p.AllowedECCurves, curve) {
+			return errors.Errorf("EC curve %s is not allowed for profile %s", curve, p.Id)
+		}
+	}
+
+	return nil
+}
+
+// checkSignatureAlgorithm enforces the allowed signature algorithms of the
+// profile, named as by x509.SignatureAlgorithm, for example "SHA256-RSA".
+func (p *CAGWConfigProfile) checkSignatureAlgorithm(algorithm x509.SignatureAlgorithm) error {
+	if len(p.AllowedSignatureAlgorithms) == 0 {
+		return nil
+	}
+	for _, allowed := range p.AllowedSignatureAlgorithms {
+		if strings.EqualFold(allowed, algorithm.String()) {
+			return nil
+		}
+	}
+	return errors.Errorf("signature algorithm %s is not allowed for profile %s", algorithm, p.Id)
+}
+
+// commonNameVariable returns the subject variable the common_name of a Vault
+// PKI style request maps to.
+func (p *CAGWConfigProfile) commonNameVariable() string {
+	if len(p.CommonNameVariable) > 0 {
+		return p.CommonNameVariable
+	}
+	return defaultCommonNameVariable
+}
+
+// sanType returns the CAGW SAN type a kind of Vault PKI style SAN maps to.
+func (p *CAGWConfigProfile) sanType(kind string) string {
+	if sanType, ok := p.SANTypes[kind]; ok {
+		return sanType
+	}
+	return defaultSANTypes[kind]
+}
+
+// sanTypeForName returns the SAN type of an untyped name, which is an email
+// address if it contains an @ and a DNS name otherwise.
+func (p *CAGWConfigProfile) sanTypeForName(name string) string {
+	if strings.Contains(name, "@") {
+		return p.sanType(sanKindEmail)
+	}
+	return p.sanType(sanKindDNS)
+}
+
+// commonNameSANType returns the SAN type a common name is copied to: an email
+// SAN for an email address and a DNS SAN for a hostname, when the profile
+// accepts that type. Other common names, such as the name of a person, are not
+// copied.
+func (p *CAGWConfigProfile) commonNameSANType(commonName string) (string, bool) {
+	if !strings.Contains(commonName, "@") && !isHostname(commonName) {
+		return "", false
+	}
+	sanType := p.sanTypeForName(commonName)
+	return sanType, p.sanTypeRequested(sanType)
+}
+
+// subjectVariableName returns the name of the subject variable requirement
+// matching the attribute name, which is compared case insensitively.
+func (p *CAGWConfigProfile) subjectVariableName(name string) (string, bool) {
+	for _, r := range p.SubjectVariableRequirements {
+		if strings.EqualFold(r.Name, name) {
+			return r.Name, true
+		}
+	}
+	return "", false
+}
+
+// sanTypeRequested tells if the profile has a requirement for the SAN type.
+func (p *CAGWConfigProfile) sanTypeRequested(sanType string) bool {
+	for _, r := range p.SubjectAltNameRequirements {
+		if strings.EqualFold(r.Type, sanType) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequirements validates the subject variables and SANs of a request
+// against the requirements of the profile and returns every violation. When
+// the request comes with a CSR, a required value is also satisfied by the CSR
+// if its subject has the attribute or it has a SAN of the type.
+func (p *CAGWConfigProfile) checkRequirements(subjectVars []SubjectVariable, altNames []SubjectAltName, csr *x509.CertificateRequest) []string {
+	var violations []string
+
+	for _, v := range subjectVars {
+		if _, ok := p.subjectVariableName(v.Type); !ok {
+			violations = append(violations, fmt.Sprintf("unknown subject variable %s", v.Type))
+		}
+	}
+	for _, a := range altNames {
+		if !p.sanTypeRequested(a.Type) {
+			violations = append(violations, fmt.Sprintf("SAN type %s is not allowed (%s)", a.Type, a.Value))
+		}
+	}
+
+	for _, r := range p.SubjectVariableRequirements {
+		if r.Required && !containsSubjectVariable(subjectVars, r.Name) && !csrHasSubjectVariable(csr, r.Name) {
+			violations = append(violations, fmt.Sprintf("missing required subject variable %s", r.Name))
+		}
+	}
+	for _, r := range p.SubjectAltNameRequirements {
+		if r.Required && !containsAltNameType(altNames, r.Type) && !p.csrHasAltNameType(csr, r.Type) {
+			violations = append(violations, fmt.Sprintf("missing required SAN of type %s", r.Type))
+		}
+	}
+
+	return violations
+}
+
+// csrHasSubjectVariable tells if the subject of the CSR has an attribute for
+// the subject variable.
+func csrHasSubjectVariable(csr *x509.CertificateRequest, name string) bool {
+	if csr == nil {
+		return false
+	}
+	for _, attr := range csr.Subject.Names {
+		rdnName, ok := rdnNames[attr.Type.String()]
+		if !ok {
+			rdnName = attr.Type.String()
+		}
+		if strings.EqualFold(rdnName, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// csrHasAltNameType tells if the CSR has a SAN of the SAN type.
+func (p *CAGWConfigProfile) csrHasAltNameType(csr *x509.CertificateRequest, sanType string) bool {
+	if csr == nil {
+		return false
+	}
+	kinds := map[string]int{
+		sanKindDNS:   len(csr.DNSNames),
+		sanKindEmail: len(csr.EmailAddresses),
+		sanKindIP:    len(csr.IPAddresses),
+		sanKindURI:   len(csr.URIs),
+	}
+	for kind, count := range kinds {
+		if count > 0 && strings.EqualFold(p.sanType(kind), sanType) {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh updates the gateway provided properties of the profile configuration
+// from a freshly fetched profile and returns what changed. The locally
+// configured properties such as the TTLs are kept.
+func (p *CAGWConfigProfile) refresh(fetched *Profile) map[string]interface{} {
+	addedVars, removedVars, changedVars := diffRequirements(
+		subjectVariableRequirementMap(p.SubjectVariableRequirements),
+		subjectVariableRequirementMap(fetched.SubjectVariableRequirements))
+	addedAltNames, removedAltNames, changedAltNames := diffRequirements(
+		subjectAltNameRequirementMap(p.SubjectAltNameRequirements),
+		subjectAltNameRequirementMap(fetched.SubjectAltNameRequirements))
+
+	drift := map[string]interface{}{
+		"Profile ID":                p.Id,
+		"Profile Name":              fetched.Name,
+		"Added Subject Variables":   addedVars,
+		"Removed Subject Variables": removedVars,
+		"Changed Subject Variables": changedVars,
+		"Added Subject Alt Names":   addedAltNames,
+		"Removed Subject Alt Names": removedAltNames,
+		"Changed Subject Alt Names": changedAltNames,
+		"Drift": len(addedVars)+len(removedVars)+len(changedVars)+
+			len(addedAltNames)+len(removedAltNames)+len(changedAltNames) > 0 || p.Name != fetched.Name,
+	}
+
+	p.Name = fetched.Name
+	p.SubjectVariableRequirements = fetched.SubjectVariableRequirements
+	p.SubjectAltNameRequirements = fetched.SubjectAltNameRequirements
+	p.LastRefreshed = time.Now()
+
+	return drift
+}
+
+func subjectVariableRequirementMap(requirements []SubjectVariableRequirement) map[string]bool {
+	ret := map[string]bool{}
+	for _, r := range requirements {
+		ret[r.Name] = r.Required
+	}
+	return ret
+}
+
+func subjectAltNameRequirementMap(requirements []SubjectAltNameRequirement) map[string]bool {
+	ret := map[string]bool{}
+	for _, r := range requirements {
+		ret[r.Type] = r.Required
+	}
+	return ret
+}
+
+// diffRequirements compares two sets of requirements keyed by name, where the
+// value tells if the field is required. Changed entries are the fields whose
+// required flag differs.
+func diffRequirements(old map[string]bool, new map[string]bool) (added []string, removed []string, changed []string) {
+	added, removed, changed = []string{}, []string{}, []string{}
+	for name, required := range new {
+		oldRequired, ok := old[name]
+		if !ok {
+			added = append(added, requirementString(name, required))
+		} else if oldRequired != required {
+			changed = append(changed, requirementString(name, required))
+		}
+	}
+	for name, required := range old {
+		if _, ok := new[name]; !ok {
+			removed = append(removed, requirementString(name, required))
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+func requirementString(name string, required bool) string {
+	if required {
+		return name + " (required)"
+	}
+	return name + " (optional)"
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"reflect"
+	"testing"
+)
+
+func TestCheckRequirements(t *testing.T) {
+	profile := CAGWConfigProfile{
+		SubjectVariableRequirements: []SubjectVariableRequirement{{Name: "cn", Required: true}, {Name: "o"}},
+		SubjectAltNameRequirements:  []SubjectAltNameRequirement{{Type: "dNSName", Required: true}},
+	}
+
+	tests := []struct {
+		name        string
+		subjectVars []SubjectVariable
+		altNames    []SubjectAltName
+		csr         *x509.CertificateRequest
+		violations  []string
+	}{
+		{
+			name:        "required values in the request",
+			subjectVars: []SubjectVariable{{Type: "cn", Value: "www.example.com"}},
+			altNames:    []SubjectAltName{{Type: "dNSName", Value: "www.example.com"}},
+		},
+		{
+			name:        "missing required values without a CSR",
+			subjectVars: []SubjectVariable{{Type: "o", Value: "Example"}, {Type: "ou", Value: "Web"}},
+			altNames:    []SubjectAltName{{Type: "rfc822Name", Value: "admin@example.com"}},
+			violations: []string{
+				"unknown subject variable ou",
+				"SAN type rfc822Name is not allowed (admin@example.com)",
+				"missing required subject variable cn",
+				"missing required SAN of type dNSName",
+			},
+		},
+		{
+			name: "required values in the CSR",
+			csr: &x509.CertificateRequest{
+				Subject:  pkix.Name{CommonName: "www.example.com"},
+				DNSNames: []string{"www.example.com"},
+			},
+		},
+		{
+			name: "required values missing from the CSR",
+			csr: &x509.CertificateRequest{
+				Subject:        pkix.Name{Organization: []string{"Example"}},
+				EmailAddresses: []string{"admin@example.com"},
+			},
+			violations: []string{
+				"missing required subject variable cn",
+				"missing required SAN of type dNSName",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.csr != nil {
+				// The subject names are filled in when a CSR is parsed
+				rdns := tt.csr.Subject.ToRDNSequence()
+				tt.csr.Subject.FillFromRDNSequence(&rdns)
+			}
+			violations := profile.checkRequirements(tt.subjectVars, tt.altNames, tt.csr)
+			if !reflect.DeepEqual(violations, tt.violations) {
+				t.Errorf("checkRequirements() = %q, want %q", violations, tt.violations)
+			}
+		})
+	}
+}
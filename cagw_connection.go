@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultConnectTimeout      = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultRequestTimeout      = 60 * time.Second
+	defaultFailoverCooldown    = 60 * time.Second
+
+	// proxyNone disables the proxy taken from the environment
+	proxyNone = "none"
+)
+
+var tlsVersions = map[string]uint16{
+	"tls10": tls.VersionTLS10,
+	"tls11": tls.VersionTLS11,
+	"tls12": tls.VersionTLS12,
+	"tls13": tls.VersionTLS13,
+}
+
+// CAGWConnection holds the gateway URLs, client credentials and trust settings.
+// It is either stored inline in a role configuration or as a named connection
+// under connections/ that any number of roles can refer to.
+type CAGWConnection struct {
+	PEMBundle      string `json:"pem_bundle"`
+	PKCS12         string `json:"pkcs12"`
+	PKCS12Password string `json:"pkcs12_password"`
+	KeyPassword    string `json:"key_password"`
+	URL            string `json:"url"`
+	CACerts        string `json:"cacerts"`
+
+	// URLs lists the gateway endpoints in order of preference. When set it
+	// takes the place of URL.
+	URLs             []string      `json:"urls"`
+	FailoverCooldown time.Duration `json:"failover_cooldown_duration"`
+
+	ConnectTimeout      time.Duration `json:"connect_timeout_duration"`
+	TLSHandshakeTimeout time.Duration `json:"tls_handshake_timeout_duration"`
+	RequestTimeout      time.Duration `json:"request_timeout_duration"`
+	ProxyURL            string        `json:"proxy_url"`
+	TLSMinVersion       string        `json:"tls_min_version"`
+	CipherSuites        []string      `json:"cipher_suites"`
+	TLSServerName       string        `json:"tls_server_name"`
+}
+
+func (c *CAGWConnection) validate() error {
+	if len(c.PEMBundle) == 0 && len(c.PKCS12) == 0 {
+		return errors.New("must provide PEM encoded certificate or PKCS#12")
+	}
+	if len(c.PEMBundle) > 0 && len(c.PKCS12) > 0 {
+		return errors.New("only one of pem_bundle and pkcs12 can be provided")
+	}
+	if len(c.URL) > 0 && len(c.URLs) > 0 {
+		return errors.New("only one of url and urls can be provided")
+	}
+	if len(c.endpoints()) == 0 {
+		return errors.New("must provide gateway URL")
+	}
+	for _, endpoint := range c.endpoints() {
+		if _, err := url.ParseRequestURI(endpoint); err != nil {
+			return errors.Wrap(err, "invalid gateway URL")
+		}
+	}
+	if len(c.CACerts) == 0 {
+		return errors.New("must provide gateway CA certificate")
+	}
+
+	if _, err := c.proxy(); err != nil {
+		return err
+	}
+	if _, err := c.tlsMinVersion(); err != nil {
+		return err
+	}
+	if _, err := c.cipherSuites(); err != nil {
+		return err
+	}
+
+	// Make sure the credentials can be loaded and that the key matches the
+	// certificate before anything is sent to the gateway.
+	if _, err := getClientCertificate(c); err != nil {
+		return errors.Wrap(err, "invalid client certificate and key")
+	}
+
+	return nil
+}
+
+func connectionFromFieldData(data *framework.FieldData) *CAGWConnection {
+	return &CAGWConnection{
+		PEMBundle:      data.Get("pem_bundle").(string),
+		PKCS12:         data.Get("pkcs12").(string),
+		PKCS12Password: data.Get("pkcs12_password").(string),
+		KeyPassword:    data.Get("key_password").(string),
+		URL:            data.Get("url").(string),
+		CACerts:        data.Get("cacerts").(string),
+
+		URLs:             data.Get("urls").([]string),
+		FailoverCooldown: time.Duration(data.Get("failover_cooldown").(int)) * time.Second,
+
+		ConnectTimeout:      time.Duration(data.Get("connect_timeout").(int)) * time.Second,
+		TLSHandshakeTimeout: time.Duration(data.Get("tls_handshake_timeout").(int)) * time.Second,
+		RequestTimeout:      time.Duration(data.Get("request_timeout").(int)) * time.Second,
+		ProxyURL:            data.Get("proxy_url").(string),
+		TLSMinVersion:       data.Get("tls_min_version").(string),
+		CipherSuites:        data.Get("cipher_suites").([]string),
+		TLSServerName:       data.Get("tls_server_name").(string),
+	}
+}
+
+// isEmpty tells if none of the connection settings are set.
+func (c *CAGWConnection) isEmpty() bool {
+	return len(c.PEMBundle) == 0 && len(c.PKCS12) == 0 && len(c.PKCS12Password) == 0 &&
+		len(c.KeyPassword) == 0 && len(c.URL) == 0 && len(c.CACerts) == 0 &&
+		len(c.URLs) == 0 && c.FailoverCooldown == 0 &&
+		c.ConnectTimeout == 0 && c.TLSHandshakeTimeout == 0 && c.RequestTimeout == 0 &&
+		len(c.ProxyURL) == 0 && len(c.TLSMinVersion) == 0 && len(c.CipherSuites) == 0 &&
+		len(c.TLSServerName) == 0
+}
+
+// endpoints returns the gateway URLs in the order they are tried.
+func (c *CAGWConnection) endpoints() []string {
+	if len(c.URLs) > 0 {
+		return c.URLs
+	}
+	if len(c.URL) > 0 {
+		return []string{c.URL}
+	}
+	return nil
+}
+
+// httpClient returns the client for calls to the gateway. Every call to the
+// gateway must use it so that the timeouts and proxy settings apply.
+func (c *CAGWConnection) httpClient(tlsClientConfig *tls.Config) (*http.Client, error) {
+	proxy, err := c.proxy()
+	if err != nil {
+		return nil, err
+	}
+
+	tr := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout: durationOrDefault(c.ConnectTimeout, defaultConnectTimeout),
+		}).DialContext,
+		TLSHandshakeTimeout: durationOrDefault(c.TLSHandshakeTimeout, defaultTLSHandshakeTimeout),
+		TLSClientConfig:     tlsClientConfig,
+	}
+
+	return &http.Client{
+		Transport: tr,
+		Timeout:   durationOrDefault(c.RequestTimeout, defaultRequestTimeout),
+	}, nil
+}
+
+func (c *CAGWConnection) proxy() (func(*http.Request) (*url.URL, error), error) {
+	switch c.ProxyURL {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case proxyNone:
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(c.ProxyURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy URL")
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+func (c *CAGWConnection) tlsMinVersion() (uint16, error) {
+	if len(c.TLSMinVersion) == 0 {
+		return 0, nil
+	}
+	version, ok := tlsVersions[strings.ToLower(c.TLSMinVersion)]
+	if !ok {
+		return 0, errors.Errorf("invalid TLS version: %s", c.TLSMinVersion)
+	}
+	return version, nil
+}
+
+func (c *CAGWConnection) cipherSuites() ([]uint16, error) {
+	if len(c.CipherSuites) == 0 {
+		return nil, nil
+	}
+
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range c.CipherSuites {
+		id, ok := known[strings.ToUpper(name)]
+		if !ok {
+			return nil, errors.Errorf("invalid or insecure cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func durationOrDefault(d time.Duration, defaultDuration time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultDuration
+	}
+	return d
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// csrEnrollment is the certificate issued for a CSR.
+type csrEnrollment struct {
+	Certificate *x509.Certificate
+	Chain       []*x509.Certificate
+	Endpoint    string
+}
+
+// missingChainWarning is returned with a certificate when the gateway sent no
+// CA chain with it, as the chain fields of the response are then empty.
+const missingChainWarning = "the gateway did not return the CA chain of the certificate; the chain, ca_chain and issuing_ca fields of the response are empty"
+
+// enroll sends an enrollment request to the CA of the role configuration and
+// returns the parsed response and the gateway endpoint that served it.
+func (b *backend) enroll(ctx context.Context, req *logical.Request, configRole *CAGWConfigRole, caId string, enrollmentRequest *EnrollmentRequest) (*EnrollmentResponse, string, error) {
+	body, err := json.Marshal(enrollmentRequest)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error constructing enrollment request: %w", err)
+	}
+
+	if b.Logger().IsDebug() {
+		b.Logger().Debug(fmt.Sprintf("Enrollment request body: %v", string(body)))
+	}
+
+	tlsClientConfig, err := getTLSConfig(ctx, req, configRole)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error retrieving TLS configuration: %w", err)
+	}
+
+	client, err := configRole.httpClient(tlsClientConfig)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error creating the gateway client: %w", err)
+	}
+
+	resp, err := configRole.request(ctx, client, http.MethodPost, "/v1/certificate-authorities/"+caId+"/enrollments", body)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error response: %w", err)
+	}
+	responseBody := resp.Body
+
+	if b.Logger().IsTrace() {
+		b.Logger().Trace("response body: " + string(responseBody))
+	}
+
+	err = CheckForError(b, responseBody, resp.StatusCode)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error response received from gateway: %w", err)
+	}
+
+	var enrollmentResponse EnrollmentResponse
+	err = json.Unmarshal(responseBody, &enrollmentResponse)
+	if err != nil {
+		return nil, "", fmt.Errorf("CAGW enrollment response could not be parsed: %w", err)
+	}
+
+	return &enrollmentResponse, resp.Endpoint, nil
+}
+
+// enrollCSR enrolls for a certificate for the DER encoded CSR. It is shared by
+// sign and by issue with a locally generated key.
+func (b *backend) enrollCSR(ctx context.Context, req *logical.Request, configRole *CAGWConfigRole, caId string, csr []byte, enrollmentRequest EnrollmentRequest) (*csrEnrollment, error) {
+	enrollmentRequest.CSR = base64.StdEncoding.EncodeToString(csr)
+	enrollmentRequest.RequiredFormat = RequiredFormat{
+		Format:     "X509",
+		Protection: nil,
+	}
+
+	enrollmentResponse, endpoint, err := b.enroll(ctx, req, configRole, caId, &enrollmentRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	certBytes, err := base64.StdEncoding.DecodeString(enrollmentResponse.Enrollment.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding base64 response from CAGW: %w", err)
+	}
+
+	certificate, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the certificate: %w", err)
+	}
+
+	var chain []*x509.Certificate
+	for _, c := range enrollmentResponse.Enrollment.Chain {
+		caBytes, err := base64.StdEncoding.DecodeString(c)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding base64 chain from CAGW: %w", err)
+		}
+		caCert, err := x509.ParseCertificate(caBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse the chain: %w", err)
+		}
+		chain = append(chain, caCert)
+	}
+
+	return &csrEnrollment{
+		Certificate: certificate,
+		Chain:       chain,
+		Endpoint:    endpoint,
+	}, nil
+}
@@ -7,9 +7,13 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
 )
 
 func opListCerts(ctx context.Context, req *logical.Request, data *framework.FieldData, path string) (response *logical.Response, retErr error) {
@@ -37,16 +41,64 @@ func opReadCert(ctx context.Context, req *logical.Request, data *framework.Field
 		return logical.ErrorResponse("could not find certificate with the serial number: " + serial), nil
 	}
 
-	var rawData map[string]interface{}
-	err = storageEntry.DecodeJSON(&rawData)
-
+	entry, err := decodeCertificateEntry(storageEntry.Value)
 	if err != nil {
 		return logical.ErrorResponse("json decoding failed for certificate: " + serial), err
 	}
 
+	serialNumber, ok := new(big.Int).SetString(entry.SerialNumber, 10)
+	if !ok {
+		return logical.ErrorResponse("invalid serial number stored for certificate: " + serial), nil
+	}
+
+	rawData := map[string]interface{}{
+		"certificate":   entry.Certificate,
+		"serial_number": serialNumber,
+	}
+	if len(entry.PrivateKey) > 0 {
+		rawData["private_key"] = entry.PrivateKey
+	}
+	if len(entry.PrivateKeyType) > 0 {
+		rawData["private_key_type"] = entry.PrivateKeyType
+	}
+	if len(entry.Chain) > 0 {
+		rawData["chain"] = entry.Chain
+	}
+	if len(entry.KeyAlgorithm) > 0 {
+		rawData["key_algorithm"] = entry.KeyAlgorithm
+	}
+	if len(entry.CSRKeyAlgorithm) > 0 {
+		rawData["csr_key_algorithm"] = entry.CSRKeyAlgorithm
+	}
+
+	if entry.ResponseMode == responseModePKI {
+		certificate, err := parsePEMCertificate(entry.Certificate)
+		if err != nil {
+			return logical.ErrorResponse("invalid certificate stored for the serial number: " + serial), nil
+		}
+		var caCerts []*x509.Certificate
+		for _, c := range entry.CAChain {
+			caCert, err := parsePEMCertificate(c)
+			if err != nil {
+				return logical.ErrorResponse("invalid CA chain stored for the serial number: " + serial), nil
+			}
+			caCerts = append(caCerts, caCert)
+		}
+		addPKIResponseFields(rawData, certificate, caCerts, "pem")
+	}
+
 	resp := &logical.Response{
 		Data: rawData,
 	}
 
 	return resp, nil
 }
+
+// parsePEMCertificate parses the first certificate of a PEM string.
+func parsePEMCertificate(certPem string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPem))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
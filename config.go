@@ -10,30 +10,70 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"github.com/pkg/errors"
 )
 
 func getConfigRole(ctx context.Context, req *logical.Request, roleName string) (*CAGWConfigRole, error) {
-	storageEntry, err := req.Storage.Get(ctx, "config/"+roleName)
-
+	storedRole, err := getStoredConfigRole(ctx, req.Storage, roleName)
 	if err != nil {
-		return nil, errors.Wrapf(err, "config/%s configuration could not be loaded", roleName)
+		return nil, err
 	}
 
-	configRole := CAGWConfigRole{}
-	if storageEntry != nil {
-		err = storageEntry.DecodeJSON(&configRole)
+	configRole := storedRole.CAGWConfigRole
+	if len(configRole.Connection) > 0 {
+		connection, err := getConnection(ctx, req.Storage, configRole.Connection)
 		if err != nil {
-			return nil, errors.Wrapf(err, "config/%s configuration could not be parsed", roleName)
+			return nil, errors.Wrapf(err, "config/%s connection could not be loaded", roleName)
 		}
-	} else {
-		return nil, errors.Errorf("config/%s could not be found", roleName)
+		configRole.CAGWConnection = *connection
 	}
+
 	return &configRole, nil
 }
 
+// getStoredConfigRole returns the role configuration as stored, without
+// resolving its connection.
+func getStoredConfigRole(ctx context.Context, storage logical.Storage, roleName string) (*CAGWConfigCAConfigProfileIDs, error) {
+	storageEntry, err := storage.Get(ctx, "config/"+roleName)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "config/%s configuration could not be loaded", roleName)
+	}
+
+	if storageEntry == nil {
+		return nil, errors.Errorf("config/%s could not be found", roleName)
+	}
+
+	configRole, err := decodeConfigRole(storageEntry.Value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "config/%s configuration could not be parsed", roleName)
+	}
+
+	return configRole, nil
+}
+
+func getConnection(ctx context.Context, storage logical.Storage, name string) (*CAGWConnection, error) {
+	storageEntry, err := storage.Get(ctx, "connections/"+name)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "connections/%s could not be loaded", name)
+	}
+
+	if storageEntry == nil {
+		return nil, errors.Errorf("connections/%s could not be found", name)
+	}
+
+	connection, err := decodeConnection(storageEntry.Value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "connections/%s could not be parsed", name)
+	}
+
+	return connection, nil
+}
+
 func getConfigProfile(ctx context.Context, req *logical.Request, roleName string, profileId string) (*CAGWConfigProfile, error) {
 	profileStorageEntry, err := req.Storage.Get(ctx, "config/"+roleName+"/profiles/"+profileId)
 
@@ -41,40 +81,116 @@ func getConfigProfile(ctx context.Context, req *logical.Request, roleName string
 		return nil, errors.Wrapf(err, "config/%s/profiles/%s could not be loaded", roleName, profileId)
 	}
 
-	configProfile := CAGWConfigProfile{}
-
-	// If there is a storage entry, decode it, else use defaults
-	if profileStorageEntry != nil {
-		err = profileStorageEntry.DecodeJSON(&configProfile)
-		if err != nil {
-			return nil, errors.Wrapf(err, "config/%s/profiles/%s could not be parsed", roleName, profileId)
-		}
-	} else {
+	if profileStorageEntry == nil {
 		return nil, errors.Errorf("config/%s/profiles/%s could not be found", roleName, profileId)
 	}
 
-	return &configProfile, nil
+	configProfile, err := decodeConfigProfile(profileStorageEntry.Value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "config/%s/profiles/%s could not be parsed", roleName, profileId)
+	}
+
+	return configProfile, nil
 }
 
-func getFormat(data *framework.FieldData) (*string, error) {
+// getFormat returns the requested output format, which must be one of the
+// given formats.
+func getFormat(data *framework.FieldData, formats ...string) (*string, error) {
 	format := data.Get("format").(string)
 	if len(format) <= 0 {
 		format = "pem"
 	}
-	if format != "pem" && format != "pem_bundle" && format != "der" {
+	if !strutil.StrListContains(formats, format) {
 		return nil, errors.New(fmt.Sprintf("Invalid format specified: %s", format))
 	}
 
 	return &format, nil
 }
 
-func getTTL(data *framework.FieldData, configProfile *CAGWConfigProfile) time.Duration {
+// getMaxTTL returns the max TTL for certificates of the profile and the limit
+// it comes from: the max_ttl of the profile, capped by the max lease TTL of
+// the mount, which Vault reports as the system max unless the mount is tuned.
+// The plugin cannot tell the two apart, so the limit names both.
+func (b *backend) getMaxTTL(configProfile *CAGWConfigProfile) (time.Duration, string) {
+	maxTTL := b.System().MaxLeaseTTL()
+	if configProfile.MaxTTL > 0 && configProfile.MaxTTL < maxTTL {
+		return configProfile.MaxTTL, "the max_ttl of the profile"
+	}
+	return maxTTL, "the mount or system max lease TTL"
+}
+
+// getTTL resolves the TTL of a request like the Vault PKI engine: the
+// requested ttl, the ttl of the profile or the default lease TTL of the mount,
+// in that order, capped by the max TTL. A warning is returned when the TTL is
+// capped.
+func (b *backend) getTTL(data *framework.FieldData, configProfile *CAGWConfigProfile) (time.Duration, []string) {
+	var warnings []string
+
 	ttl := time.Duration(data.Get("ttl").(int)) * time.Second
 	if ttl <= 0 {
 		ttl = configProfile.TTL
 	}
-	if configProfile.MaxTTL > 0 && ttl > configProfile.MaxTTL {
-		ttl = configProfile.MaxTTL
+	if ttl <= 0 {
+		ttl = b.System().DefaultLeaseTTL()
+	}
+
+	maxTTL, limit := b.getMaxTTL(configProfile)
+	if ttl > maxTTL {
+		warnings = append(warnings, fmt.Sprintf("TTL of %s is greater than %s (%s), capping to %s", ttl, limit, maxTTL, maxTTL))
+		ttl = maxTTL
+	}
+	return ttl, warnings
+}
+
+// getValidityPeriod returns the validity period to send to CAGW. Without
+// not_after or not_before_duration it is the TTL as an ISO 8601 duration in
+// whole minutes. Otherwise it is an ISO 8601 interval from now, backdated by
+// not_before_duration, to not_after or to the end of the TTL. The interval,
+// backdating included, cannot be longer than the max TTL.
+func (b *backend) getValidityPeriod(data *framework.FieldData, configProfile *CAGWConfigProfile) (string, []string, error) {
+	notAfterString := data.Get("not_after").(string)
+	notBeforeDuration := time.Duration(data.Get("not_before_duration").(int)) * time.Second
+	if notBeforeDuration < 0 {
+		return "", nil, errors.New("not_before_duration cannot be negative")
+	}
+
+	ttl, warnings := b.getTTL(data, configProfile)
+	if len(notAfterString) == 0 && notBeforeDuration == 0 {
+		return fmt.Sprintf("PT%dM", int64(ttl.Minutes())), warnings, nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	notAfter := now.Add(ttl)
+	if len(notAfterString) > 0 {
+		if data.Get("ttl").(int) > 0 {
+			return "", nil, errors.New("ttl and not_after cannot be combined")
+		}
+		parsed, err := time.Parse(time.RFC3339, notAfterString)
+		if err != nil {
+			return "", nil, errors.Errorf("not_after is not an RFC 3339 date: %s", notAfterString)
+		}
+		notAfter = parsed.UTC()
+		if !notAfter.After(now) {
+			return "", nil, errors.Errorf("not_after %s is in the past", notAfterString)
+		}
+		// The TTL is not used, so neither is its warning
+		warnings = nil
 	}
-	return ttl
+
+	// The whole validity period, backdating included, is capped like the TTL
+	notBefore := now.Add(-notBeforeDuration)
+	if maxTTL, limit := b.getMaxTTL(configProfile); notAfter.Sub(notBefore) > maxTTL {
+		switch {
+		case len(notAfterString) > 0 && notAfter.Sub(now) > maxTTL:
+			return "", nil, errors.Errorf("not_after %s is beyond %s (%s)", notAfterString, limit, maxTTL)
+		case len(notAfterString) > 0:
+			return "", nil, errors.Errorf("the validity period from not_before_duration to not_after %s is longer than %s (%s)", notAfterString, limit, maxTTL)
+		case notBeforeDuration >= maxTTL:
+			return "", nil, errors.Errorf("not_before_duration %s is not shorter than %s (%s)", notBeforeDuration, limit, maxTTL)
+		}
+		notAfter = notBefore.Add(maxTTL)
+		warnings = append(warnings, fmt.Sprintf("the TTL was shortened to %s so that the validity period including not_before_duration stays within %s (%s)", notAfter.Sub(now), limit, maxTTL))
+	}
+
+	return notBefore.Format(time.RFC3339) + "/" + notAfter.Format(time.RFC3339), warnings, nil
 }
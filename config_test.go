@@ -0,0 +1,257 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// newTTLTestBackend returns a backend whose mount has a default lease TTL of
+// 24 hours and a max lease TTL of 48 hours.
+func newTTLTestBackend(t *testing.T) *backend {
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	config.System = &logical.StaticSystemView{
+		DefaultLeaseTTLVal: 24 * time.Hour,
+		MaxLeaseTTLVal:     48 * time.Hour,
+	}
+	b, err := Factory(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Factory failed: %v", err)
+	}
+	return b.(*backend)
+}
+
+func issueFieldData(raw map[string]interface{}) *framework.FieldData {
+	return &framework.FieldData{
+		Raw:    raw,
+		Schema: addIssueAndSignCommonFields(map[string]*framework.FieldSchema{}),
+	}
+}
+
+func TestGetMaxTTL(t *testing.T) {
+	b := newTTLTestBackend(t)
+
+	tests := []struct {
+		name    string
+		profile CAGWConfigProfile
+		maxTTL  time.Duration
+		limit   string
+	}{
+		{
+			name:   "mount or system max",
+			maxTTL: 48 * time.Hour,
+			limit:  "the mount or system max lease TTL",
+		},
+		{
+			name:    "profile max",
+			profile: CAGWConfigProfile{MaxTTL: 12 * time.Hour},
+			maxTTL:  12 * time.Hour,
+			limit:   "the max_ttl of the profile",
+		},
+		{
+			name:    "profile max above the mount or system max",
+			profile: CAGWConfigProfile{MaxTTL: 72 * time.Hour},
+			maxTTL:  48 * time.Hour,
+			limit:   "the mount or system max lease TTL",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxTTL, limit := b.getMaxTTL(&tt.profile)
+			if maxTTL != tt.maxTTL || limit != tt.limit {
+				t.Errorf("getMaxTTL() = %s, %q, want %s, %q", maxTTL, limit, tt.maxTTL, tt.limit)
+			}
+		})
+	}
+}
+
+func TestGetTTL(t *testing.T) {
+	b := newTTLTestBackend(t)
+
+	tests := []struct {
+		name     string
+		raw      map[string]interface{}
+		profile  CAGWConfigProfile
+		ttl      time.Duration
+		warnings []string
+	}{
+		{
+			name:    "requested ttl",
+			raw:     map[string]interface{}{"ttl": "1h"},
+			profile: CAGWConfigProfile{TTL: 2 * time.Hour},
+			ttl:     time.Hour,
+		},
+		{
+			name:    "profile ttl",
+			profile: CAGWConfigProfile{TTL: 2 * time.Hour},
+			ttl:     2 * time.Hour,
+		},
+		{
+			name: "default lease ttl",
+			ttl:  24 * time.Hour,
+		},
+		{
+			name:     "capped by the mount or system max",
+			raw:      map[string]interface{}{"ttl": "72h"},
+			ttl:      48 * time.Hour,
+			warnings: []string{"TTL of 72h0m0s is greater than the mount or system max lease TTL (48h0m0s), capping to 48h0m0s"},
+		},
+		{
+			name:     "capped by the profile max",
+			profile:  CAGWConfigProfile{MaxTTL: 12 * time.Hour},
+			ttl:      12 * time.Hour,
+			warnings: []string{"TTL of 24h0m0s is greater than the max_ttl of the profile (12h0m0s), capping to 12h0m0s"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, warnings := b.getTTL(issueFieldData(tt.raw), &tt.profile)
+			if ttl != tt.ttl {
+				t.Errorf("getTTL() = %s, want %s", ttl, tt.ttl)
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("warnings = %q, want %q", warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestGetValidityPeriod(t *testing.T) {
+	b := newTTLTestBackend(t)
+	at := func(d time.Duration) string {
+		return time.Now().UTC().Add(d).Format(time.RFC3339)
+	}
+
+	tests := []struct {
+		name     string
+		raw      map[string]interface{}
+		profile  CAGWConfigProfile
+		period   string
+		span     time.Duration
+		warnings []string
+		err      string
+	}{
+		{
+			name:   "ttl as a duration",
+			raw:    map[string]interface{}{"ttl": "90m"},
+			period: "PT90M",
+		},
+		{
+			name: "backdated ttl",
+			raw:  map[string]interface{}{"ttl": "1h", "not_before_duration": "30s"},
+			span: time.Hour + 30*time.Second,
+		},
+		{
+			name: "not_after",
+			raw:  map[string]interface{}{"not_after": at(2 * time.Hour), "not_before_duration": "1m"},
+			span: 2*time.Hour + time.Minute,
+		},
+		{
+			name:     "backdated ttl capped by the mount or system max",
+			raw:      map[string]interface{}{"ttl": "48h", "not_before_duration": "1h"},
+			span:     48 * time.Hour,
+			warnings: []string{"the TTL was shortened to 47h0m0s so that the validity period including not_before_duration stays within the mount or system max lease TTL (48h0m0s)"},
+		},
+		{
+			name:    "backdated ttl capped by the profile max",
+			raw:     map[string]interface{}{"not_before_duration": "1h"},
+			profile: CAGWConfigProfile{MaxTTL: 12 * time.Hour},
+			span:    12 * time.Hour,
+			warnings: []string{
+				"TTL of 24h0m0s is greater than the max_ttl of the profile (12h0m0s), capping to 12h0m0s",
+				"the TTL was shortened to 11h0m0s so that the validity period including not_before_duration stays within the max_ttl of the profile (12h0m0s)",
+			},
+		},
+		{
+			name: "ttl and not_after",
+			raw:  map[string]interface{}{"ttl": "1h", "not_after": at(time.Hour)},
+			err:  "ttl and not_after cannot be combined",
+		},
+		{
+			name: "invalid not_after",
+			raw:  map[string]interface{}{"not_after": "tomorrow"},
+			err:  "not_after is not an RFC 3339 date: tomorrow",
+		},
+		{
+			name: "not_after in the past",
+			raw:  map[string]interface{}{"not_after": at(-time.Hour)},
+			err:  "is in the past",
+		},
+		{
+			name: "not_after beyond the mount or system max",
+			raw:  map[string]interface{}{"not_after": at(72 * time.Hour)},
+			err:  "is beyond the mount or system max lease TTL (48h0m0s)",
+		},
+		{
+			name:    "not_after beyond the profile max",
+			raw:     map[string]interface{}{"not_after": at(24 * time.Hour)},
+			profile: CAGWConfigProfile{MaxTTL: 12 * time.Hour},
+			err:     "is beyond the max_ttl of the profile (12h0m0s)",
+		},
+		{
+			name: "backdated not_after beyond the max",
+			raw:  map[string]interface{}{"not_after": at(47 * time.Hour), "not_before_duration": "2h"},
+			err:  "is longer than the mount or system max lease TTL (48h0m0s)",
+		},
+		{
+			name: "not_before_duration beyond the max",
+			raw:  map[string]interface{}{"not_before_duration": "48h"},
+			err:  "not_before_duration 48h0m0s is not shorter than the mount or system max lease TTL (48h0m0s)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			period, warnings, err := b.getValidityPeriod(issueFieldData(tt.raw), &tt.profile)
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("getValidityPeriod() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getValidityPeriod() failed: %v", err)
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("warnings = %q, want %q", warnings, tt.warnings)
+			}
+			if len(tt.period) > 0 {
+				if period != tt.period {
+					t.Errorf("getValidityPeriod() = %s, want %s", period, tt.period)
+				}
+				return
+			}
+
+			// Intervals start now, so only their length is compared, allowing
+			// for not_after being computed a second earlier
+			bounds := strings.Split(period, "/")
+			if len(bounds) != 2 {
+				t.Fatalf("getValidityPeriod() = %s, want an interval", period)
+			}
+			notBefore, err := time.Parse(time.RFC3339, bounds[0])
+			if err != nil {
+				t.Fatalf("invalid start of the interval %s: %v", period, err)
+			}
+			notAfter, err := time.Parse(time.RFC3339, bounds[1])
+			if err != nil {
+				t.Fatalf("invalid end of the interval %s: %v", period, err)
+			}
+			if span := notAfter.Sub(notBefore); span > tt.span || span < tt.span-time.Second {
+				t.Errorf("getValidityPeriod() = %s spanning %s, want %s", period, span, tt.span)
+			}
+		})
+	}
+}
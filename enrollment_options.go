@@ -0,0 +1,292 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/pkg/errors"
+)
+
+// reservedEnrollmentOptions are the enrollment request fields the plugin sets
+// itself, which cannot be set, in whole or in part, with enrollment options.
+// Other fields of optionalCertificateRequestDetails can be set.
+var reservedEnrollmentOptions = []string{
+	"profileId",
+	"requiredFormat",
+	"csr",
+	"subjectVariables",
+	"subjectAltNames",
+	"optionalCertificateRequestDetails.validityPeriod",
+}
+
+// requestDetailsOption is the enrollment request field that holds the
+// optional certificate request details.
+const requestDetailsOption = "optionalCertificateRequestDetails"
+
+// modeledRequestDetails are the optional certificate request details that
+// are typed fields of CertificateRequestDetails, as normalized option keys.
+var modeledRequestDetails = []string{
+	"trackinginfo",
+	"requestername",
+	"requesteremail",
+	"requesterphone",
+	"additionalemails",
+	"customfields",
+}
+
+// normalizeEnrollmentOptionKey returns the form in which enrollment option
+// keys are compared. Keys are compared case-insensitively everywhere, as the
+// options are merged into the request whatever the case of the field names.
+func normalizeEnrollmentOptionKey(key string) string {
+	return strings.ToLower(key)
+}
+
+// validateEnrollmentOptionKey checks that a key names a field of the
+// enrollment request that can be passed through. Nested fields are named with
+// dots, for example "optionalCertificateRequestDetails.<field>".
+func validateEnrollmentOptionKey(key string) error {
+	for _, part := range strings.Split(key, ".") {
+		if len(part) == 0 {
+			return errors.Errorf("invalid enrollment option %q", key)
+		}
+	}
+
+	normalized := normalizeEnrollmentOptionKey(key)
+	if normalized == normalizeEnrollmentOptionKey(requestDetailsOption) {
+		return errors.Errorf("enrollment option %q is set by the plugin", key)
+	}
+	for _, reserved := range reservedEnrollmentOptions {
+		reserved = normalizeEnrollmentOptionKey(reserved)
+		if normalized == reserved || strings.HasPrefix(normalized, reserved+".") {
+			return errors.Errorf("enrollment option %q is set by the plugin", key)
+		}
+	}
+	return nil
+}
+
+// enrollmentOptionsOverlap tells if one normalized option key names a field
+// within the field named by the other, for example "a.b" and "a.b.c".
+func enrollmentOptionsOverlap(a string, b string) bool {
+	return strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+// sortedEnrollmentOptionKeys returns the keys of the options in sorted order,
+// which is the order the options are checked and applied in.
+func sortedEnrollmentOptionKeys(options map[string]string) []string {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateFixedEnrollmentOptions checks the fixed enrollment options of a
+// profile, which cannot name the same field twice or a field within another.
+func validateFixedEnrollmentOptions(fixed map[string]string) error {
+	seen := map[string]string{}
+	for _, key := range sortedEnrollmentOptionKeys(fixed) {
+		if err := validateEnrollmentOptionKey(key); err != nil {
+			return err
+		}
+		normalized := normalizeEnrollmentOptionKey(key)
+		if other, ok := seen[normalized]; ok {
+			return errors.Errorf("enrollment options %q and %q name the same field", other, key)
+		}
+		for otherNormalized, other := range seen {
+			if enrollmentOptionsOverlap(normalized, otherNormalized) {
+				return errors.Errorf("enrollment options %q and %q overlap", other, key)
+			}
+		}
+		seen[normalized] = key
+	}
+	return nil
+}
+
+// enrollmentOptionValue converts an option value to the value sent to CAGW.
+// JSON objects and arrays are sent as such, other values as strings.
+func enrollmentOptionValue(value string) interface{} {
+	trimmed := strings.TrimSpace(value)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(trimmed), &parsed); err == nil {
+			return parsed
+		}
+	}
+	return value
+}
+
+// enrollmentOptions returns the enrollment options to send for a request: the
+// requested options that the profile allows and the fixed options of the
+// profile. Requested options that are not allowed, that differ from a fixed
+// option, that name a field within a fixed option or that contains one, or
+// that name the same field as another requested option, in whole or in part,
+// are reported as violations. All keys are compared in their normalized form.
+func (p *CAGWConfigProfile) enrollmentOptions(requested map[string]string) (map[string]interface{}, []string) {
+	var violations []string
+	options := map[string]interface{}{}
+
+	fixed := map[string]string{}
+	fixedKeys := map[string]string{}
+	var fixedNormalized []string
+	for _, key := range sortedEnrollmentOptionKeys(p.FixedEnrollmentOptions) {
+		normalized := normalizeEnrollmentOptionKey(key)
+		fixed[normalized] = p.FixedEnrollmentOptions[key]
+		fixedKeys[normalized] = key
+		fixedNormalized = append(fixedNormalized, normalized)
+		options[key] = enrollmentOptionValue(p.FixedEnrollmentOptions[key])
+	}
+	allowed := make([]string, 0, len(p.AllowedEnrollmentOptions))
+	for _, pattern := range p.AllowedEnrollmentOptions {
+		allowed = append(allowed, normalizeEnrollmentOptionKey(pattern))
+	}
+
+	seen := map[string]string{}
+	var seenKeys []string
+	for _, key := range sortedEnrollmentOptionKeys(requested) {
+		value := requested[key]
+		normalized := normalizeEnrollmentOptionKey(key)
+		if other, ok := seen[normalized]; ok {
+			violations = append(violations, fmt.Sprintf("enrollment options %s and %s name the same field", other, key))
+			continue
+		}
+		if overlap := overlappingEnrollmentOption(normalized, seenKeys, seen); len(overlap) > 0 {
+			violations = append(violations, fmt.Sprintf("enrollment options %s and %s overlap", overlap, key))
+			continue
+		}
+		seen[normalized] = key
+		seenKeys = append(seenKeys, normalized)
+
+		if fixedValue, ok := fixed[normalized]; ok {
+			if value != fixedValue {
+				violations = append(violations, fmt.Sprintf("enrollment option %s is fixed to %s by the profile", key, fixedValue))
+			}
+			continue
+		}
+		if overlap := overlappingEnrollmentOption(normalized, fixedNormalized, fixedKeys); len(overlap) > 0 {
+			violations = append(violations, fmt.Sprintf("enrollment option %s overlaps the enrollment option %s fixed by the profile", key, overlap))
+			continue
+		}
+		if err := validateEnrollmentOptionKey(key); err != nil {
+			violations = append(violations, err.Error())
+			continue
+		}
+		if !strutil.StrListContainsGlob(allowed, normalized) {
+			violations = append(violations, fmt.Sprintf("enrollment option %s is not allowed by the profile", key))
+			continue
+		}
+		options[key] = enrollmentOptionValue(value)
+	}
+
+	return options, violations
+}
+
+// overlappingEnrollmentOption returns the key of the first of the normalized
+// keys that overlaps the normalized key, or an empty string.
+func overlappingEnrollmentOption(normalized string, normalizedKeys []string, keys map[string]string) string {
+	for _, other := range normalizedKeys {
+		if enrollmentOptionsOverlap(normalized, other) {
+			return keys[other]
+		}
+	}
+	return ""
+}
+
+// requestDetailsFromOptions moves the enrollment options that set a typed
+// field of the optional certificate request details onto that field, and
+// returns the details together with the remaining options. The validity
+// period is left to the caller.
+func requestDetailsFromOptions(options map[string]interface{}) (CertificateRequestDetails, map[string]interface{}, error) {
+	var details CertificateRequestDetails
+	prefix := normalizeEnrollmentOptionKey(requestDetailsOption) + "."
+
+	fields := map[string]interface{}{}
+	remaining := map[string]interface{}{}
+	for key, value := range options {
+		normalized := normalizeEnrollmentOptionKey(key)
+		if !strings.HasPrefix(normalized, prefix) || !strutil.StrListContains(modeledRequestDetails, normalized[len(prefix):]) {
+			remaining[key] = value
+			continue
+		}
+		field := normalized[len(prefix):]
+		// Additional emails can also be given as a comma separated list
+		if s, ok := value.(string); ok && field == "additionalemails" {
+			value = strutil.ParseStringSlice(s, ",")
+		}
+		fields[field] = value
+	}
+	if len(fields) == 0 {
+		return details, remaining, nil
+	}
+
+	// The JSON decoder matches the normalized keys to the typed fields
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return details, nil, err
+	}
+	if err := json.Unmarshal(raw, &details); err != nil {
+		return details, nil, errors.Wrap(err, "invalid "+requestDetailsOption+" enrollment option")
+	}
+	return details, remaining, nil
+}
+
+// MarshalJSON adds the enrollment options to the modeled fields of the
+// enrollment request, in the sorted order of their keys.
+func (r EnrollmentRequest) MarshalJSON() ([]byte, error) {
+	type enrollmentRequest EnrollmentRequest
+	body, err := json.Marshal(enrollmentRequest(r))
+	if err != nil || len(r.Options) == 0 {
+		return body, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(r.Options))
+	for key := range r.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := setEnrollmentOption(fields, strings.Split(key, "."), r.Options[key]); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// setEnrollmentOption sets the field at the path, matching the field names of
+// the request case-insensitively like the option keys.
+func setEnrollmentOption(fields map[string]interface{}, path []string, value interface{}) error {
+	name := path[0]
+	for existing := range fields {
+		if normalizeEnrollmentOptionKey(existing) == normalizeEnrollmentOptionKey(name) {
+			name = existing
+			break
+		}
+	}
+
+	if len(path) == 1 {
+		fields[name] = value
+		return nil
+	}
+
+	nested, ok := fields[name].(map[string]interface{})
+	if !ok {
+		if _, exists := fields[name]; exists {
+			return errors.Errorf("enrollment option %s is not an object", name)
+		}
+		nested = map[string]interface{}{}
+		fields[name] = nested
+	}
+	return setEnrollmentOption(nested, path[1:], value)
+}
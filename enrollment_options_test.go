@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnrollmentOptions(t *testing.T) {
+	profile := CAGWConfigProfile{
+		AllowedEnrollmentOptions: []string{"optionalCertificateRequestDetails.*", "trackingId"},
+		FixedEnrollmentOptions:   map[string]string{"optionalCertificateRequestDetails.trackingInfo": "T1"},
+	}
+
+	tests := []struct {
+		name       string
+		requested  map[string]string
+		options    map[string]interface{}
+		violations []string
+	}{
+		{
+			name:      "allowed options",
+			requested: map[string]string{"optionalCertificateRequestDetails.requesterName": "Bob", "trackingId": "7"},
+			options: map[string]interface{}{
+				"optionalCertificateRequestDetails.trackingInfo":  "T1",
+				"optionalCertificateRequestDetails.requesterName": "Bob",
+				"trackingId": "7",
+			},
+		},
+		{
+			name:      "allowed options in another case",
+			requested: map[string]string{"OPTIONALCERTIFICATEREQUESTDETAILS.requesterName": "Bob", "TrackingID": "7"},
+			options: map[string]interface{}{
+				"optionalCertificateRequestDetails.trackingInfo":  "T1",
+				"OPTIONALCERTIFICATEREQUESTDETAILS.requesterName": "Bob",
+				"TrackingID": "7",
+			},
+		},
+		{
+			name:      "fixed option with its value",
+			requested: map[string]string{"optionalcertificaterequestdetails.TRACKINGINFO": "T1"},
+			options:   map[string]interface{}{"optionalCertificateRequestDetails.trackingInfo": "T1"},
+		},
+		{
+			name:       "fixed option overridden in another case",
+			requested:  map[string]string{"optionalcertificaterequestdetails.TRACKINGINFO": "T2"},
+			options:    map[string]interface{}{"optionalCertificateRequestDetails.trackingInfo": "T1"},
+			violations: []string{"enrollment option optionalcertificaterequestdetails.TRACKINGINFO is fixed to T1 by the profile"},
+		},
+		{
+			name:       "reserved option in another case",
+			requested:  map[string]string{"OptionalCertificateRequestDetails.ValidityPeriod": "P1D"},
+			options:    map[string]interface{}{"optionalCertificateRequestDetails.trackingInfo": "T1"},
+			violations: []string{`enrollment option "OptionalCertificateRequestDetails.ValidityPeriod" is set by the plugin`},
+		},
+		{
+			name:       "same field twice",
+			requested:  map[string]string{"trackingId": "1", "TrackingId": "2"},
+			options:    map[string]interface{}{"optionalCertificateRequestDetails.trackingInfo": "T1", "TrackingId": "2"},
+			violations: []string{"enrollment options TrackingId and trackingId name the same field"},
+		},
+		{
+			name:       "option that is not allowed",
+			requested:  map[string]string{"customer": "x"},
+			options:    map[string]interface{}{"optionalCertificateRequestDetails.trackingInfo": "T1"},
+			violations: []string{"enrollment option customer is not allowed by the profile"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, violations := profile.enrollmentOptions(tt.requested)
+			if !reflect.DeepEqual(options, tt.options) {
+				t.Errorf("enrollmentOptions() options = %v, want %v", options, tt.options)
+			}
+			if !reflect.DeepEqual(violations, tt.violations) {
+				t.Errorf("enrollmentOptions() violations = %q, want %q", violations, tt.violations)
+			}
+		})
+	}
+}
+
+func TestRequestDetailsFromOptions(t *testing.T) {
+	details, remaining, err := requestDetailsFromOptions(map[string]interface{}{
+		"optionalCertificateRequestDetails.trackingInfo":     "T1",
+		"OPTIONALCERTIFICATEREQUESTDETAILS.requestername":    "Bob",
+		"optionalCertificateRequestDetails.additionalEmails": "a@example.com, b@example.com",
+		"optionalCertificateRequestDetails.customFields":     map[string]interface{}{"text1": "v"},
+		"optionalCertificateRequestDetails.other":            "z",
+		"trackingId": "7",
+	})
+	if err != nil {
+		t.Fatalf("requestDetailsFromOptions() failed: %v", err)
+	}
+
+	want := CertificateRequestDetails{
+		TrackingInfo:     "T1",
+		RequesterName:    "Bob",
+		AdditionalEmails: []string{"a@example.com", "b@example.com"},
+		CustomFields:     map[string]string{"text1": "v"},
+	}
+	if !reflect.DeepEqual(details, want) {
+		t.Errorf("requestDetailsFromOptions() details = %+v, want %+v", details, want)
+	}
+	wantRemaining := map[string]interface{}{"optionalCertificateRequestDetails.other": "z", "trackingId": "7"}
+	if !reflect.DeepEqual(remaining, wantRemaining) {
+		t.Errorf("requestDetailsFromOptions() options = %v, want %v", remaining, wantRemaining)
+	}
+
+	if _, _, err := requestDetailsFromOptions(map[string]interface{}{"optionalCertificateRequestDetails.customFields": "text"}); err == nil {
+		t.Error("requestDetailsFromOptions() accepted custom fields that are not an object")
+	}
+}
+
+func TestEnrollmentOptionsOverlap(t *testing.T) {
+	profile := CAGWConfigProfile{
+		AllowedEnrollmentOptions: []string{"optionalCertificateRequestDetails.*"},
+		FixedEnrollmentOptions: map[string]string{
+			"optionalCertificateRequestDetails.customFields.team": "ops",
+			"optionalCertificateRequestDetails.trackingInfo":      "T1",
+		},
+	}
+	fixedOptions := map[string]interface{}{
+		"optionalCertificateRequestDetails.customFields.team": "ops",
+		"optionalCertificateRequestDetails.trackingInfo":      "T1",
+	}
+
+	tests := []struct {
+		name       string
+		requested  map[string]string
+		options    map[string]interface{}
+		violations []string
+	}{
+		{
+			name:      "field next to a fixed option",
+			requested: map[string]string{"optionalCertificateRequestDetails.customFields.site": "east"},
+			options: map[string]interface{}{
+				"optionalCertificateRequestDetails.customFields.team": "ops",
+				"optionalCertificateRequestDetails.trackingInfo":      "T1",
+				"optionalCertificateRequestDetails.customFields.site": "east",
+			},
+		},
+		{
+			name:       "field within a fixed option",
+			requested:  map[string]string{"OptionalCertificateRequestDetails.TrackingInfo.id": "T2"},
+			options:    fixedOptions,
+			violations: []string{"enrollment option OptionalCertificateRequestDetails.TrackingInfo.id overlaps the enrollment option optionalCertificateRequestDetails.trackingInfo fixed by the profile"},
+		},
+		{
+			name:       "field containing a fixed option",
+			requested:  map[string]string{"optionalCertificateRequestDetails.customFields": `{"team":"dev"}`},
+			options:    fixedOptions,
+			violations: []string{"enrollment option optionalCertificateRequestDetails.customFields overlaps the enrollment option optionalCertificateRequestDetails.customFields.team fixed by the profile"},
+		},
+		{
+			name: "requested options that overlap",
+			requested: map[string]string{
+				"optionalCertificateRequestDetails.requesterName":       "Bob",
+				"optionalCertificateRequestDetails.RequesterName.first": "Bob",
+			},
+			options: map[string]interface{}{
+				"optionalCertificateRequestDetails.customFields.team":   "ops",
+				"optionalCertificateRequestDetails.trackingInfo":        "T1",
+				"optionalCertificateRequestDetails.RequesterName.first": "Bob",
+			},
+			violations: []string{"enrollment options optionalCertificateRequestDetails.RequesterName.first and optionalCertificateRequestDetails.requesterName overlap"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, violations := profile.enrollmentOptions(tt.requested)
+			if !reflect.DeepEqual(options, tt.options) {
+				t.Errorf("enrollmentOptions() options = %v, want %v", options, tt.options)
+			}
+			if !reflect.DeepEqual(violations, tt.violations) {
+				t.Errorf("enrollmentOptions() violations = %q, want %q", violations, tt.violations)
+			}
+		})
+	}
+}
+
+func TestValidateFixedEnrollmentOptionsOverlap(t *testing.T) {
+	err := validateFixedEnrollmentOptions(map[string]string{
+		"optionalCertificateRequestDetails.customFields":      `{"site":"east"}`,
+		"optionalCertificateRequestDetails.CustomFields.team": "ops",
+	})
+	want := `enrollment options "optionalCertificateRequestDetails.CustomFields.team" and "optionalCertificateRequestDetails.customFields" overlap`
+	if err == nil || err.Error() != want {
+		t.Errorf("validateFixedEnrollmentOptions() = %v, want %s", err, want)
+	}
+}
+
+func TestEnrollmentRequestMarshalJSONOrder(t *testing.T) {
+	request := EnrollmentRequest{
+		ProfileId: "profile01",
+		Options: map[string]interface{}{
+			"Extensions.b": "1",
+			"extensions.a": "2",
+			"extensions.c": "3",
+		},
+	}
+	want := `{"Extensions":{"a":"2","b":"1","c":"3"},`
+
+	// The options are applied in sorted order whatever the order of the map
+	for i := 0; i < 20; i++ {
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatalf("MarshalJSON() failed: %v", err)
+		}
+		if !strings.HasPrefix(string(body), want) {
+			t.Fatalf("MarshalJSON() = %s, want it to start with %s", body, want)
+		}
+	}
+}
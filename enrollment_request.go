@@ -12,6 +12,10 @@ type EnrollmentRequest struct {
 	SubjectVariables                  []SubjectVariable         `json:"subjectVariables"`
 	SubjectAltNames                   []SubjectAltName          `json:"subjectAltNames"`
 	OptionalCertificateRequestDetails CertificateRequestDetails `json:"optionalCertificateRequestDetails"`
+
+	// Options are further fields of the enrollment request, keyed by their
+	// name or their dotted path, that are passed through to CAGW.
+	Options map[string]interface{} `json:"-"`
 }
 
 type RequiredFormat struct {
@@ -34,6 +38,15 @@ type SubjectAltName struct {
 	Value string `json:"value"`
 }
 
+// CertificateRequestDetails are the optional details of an enrollment
+// request. The validity period is set by the plugin, the other details come
+// from the enrollment options.
 type CertificateRequestDetails struct {
-	ValidityPeriod string `json:"validityPeriod"`
+	ValidityPeriod   string            `json:"validityPeriod"`
+	TrackingInfo     string            `json:"trackingInfo,omitempty"`
+	RequesterName    string            `json:"requesterName,omitempty"`
+	RequesterEmail   string            `json:"requesterEmail,omitempty"`
+	RequesterPhone   string            `json:"requesterPhone,omitempty"`
+	AdditionalEmails []string          `json:"additionalEmails,omitempty"`
+	CustomFields     map[string]string `json:"customFields,omitempty"`
 }
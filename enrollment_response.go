@@ -14,4 +14,7 @@ type Enrollment struct {
 	Id     string `json:"id"`
 	Status string `json:"status"`
 	Body   string `json:"body"`
+	// Chain holds the base64 encoded issuer certificates, if the gateway
+	// includes them with an X509 enrollment
+	Chain []string `json:"chain,omitempty"`
 }
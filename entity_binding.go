@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/helper/identity"
+	"github.com/hashicorp/vault/logical"
+)
+
+// checkEntityBinding enforces the entity_bound_names of the profile: every DNS
+// name of a request, in the common name or the DNS SANs, must equal one of the
+// names resolved from the identity of the caller or, with
+// entity_bound_subdomains, be under one of them. Templates that cannot be
+// resolved for the caller, for example because the metadata key is not set,
+// bind no name. The violations are returned, none if the profile has no
+// entity binding.
+func (p *CAGWConfigProfile) checkEntityBinding(names []string, entity *identity.Entity) []string {
+	if len(p.EntityBoundNames) == 0 {
+		return nil
+	}
+	if entity == nil {
+		return []string{"the token has no identity entity to bind names to"}
+	}
+
+	var boundNames []string
+	for _, template := range p.EntityBoundNames {
+		name, err := populateTemplate(template, entity)
+		if err != nil || len(name) == 0 {
+			continue
+		}
+		boundNames = append(boundNames, strings.ToLower(name))
+	}
+	if len(boundNames) == 0 {
+		return []string{"no name could be resolved from the identity entity of the caller"}
+	}
+
+	var violations []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if !p.boundNameAllowed(name, boundNames) {
+			violations = append(violations, fmt.Sprintf("name %s is not bound to the identity of the caller (%s)", name, strings.Join(boundNames, ", ")))
+		}
+	}
+	return violations
+}
+
+func (p *CAGWConfigProfile) boundNameAllowed(name string, boundNames []string) bool {
+	for _, bound := range boundNames {
+		if name == bound {
+			return true
+		}
+		if p.EntityBoundSubdomains && strings.HasSuffix(name, "."+bound) {
+			return true
+		}
+	}
+	return false
+}
+
+// entityBindingErrorResponse denies a request that breaks the entity binding
+// of the profile. It is returned with logical.ErrPermissionDenied so that
+// Vault answers with 403 rather than 400.
+func entityBindingErrorResponse(violations []string) *logical.Response {
+	resp := logical.ErrorResponse("Request denied by the entity binding of the profile: " + strings.Join(violations, "; "))
+	resp.Data["errors"] = violations
+	return resp
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/helper/identity"
+)
+
+func TestCheckEntityBinding(t *testing.T) {
+	entity := &identity.Entity{
+		ID:       "entity-1",
+		Name:     "Web01",
+		Metadata: map[string]string{"team": "payments"},
+		Aliases: []*identity.Alias{
+			{MountAccessor: "auth_kubernetes_1a2b3c4d", Name: "web01", Metadata: map[string]string{"service_account_name": "checkout"}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		profile    CAGWConfigProfile
+		names      []string
+		entity     *identity.Entity
+		violations []string
+	}{
+		{
+			name:   "profile without entity binding",
+			names:  []string{"anything.example.org"},
+			entity: nil,
+		},
+		{
+			name:    "bound name",
+			profile: CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.name}}.example.com"}},
+			names:   []string{"web01.example.com"},
+			entity:  entity,
+		},
+		{
+			name:    "bound name from alias metadata",
+			profile: CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.aliases.auth_kubernetes_1a2b3c4d.metadata.service_account_name}}.apps.example.com"}},
+			names:   []string{"checkout.apps.example.com"},
+			entity:  entity,
+		},
+		{
+			name:    "names are case folded",
+			profile: CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.name}}.Example.com"}},
+			names:   []string{"WEB01.EXAMPLE.COM", "web01.example.com"},
+			entity:  entity,
+		},
+		{
+			name:    "any bound name",
+			profile: CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.name}}.example.com", "{{identity.entity.metadata.team}}.example.com"}},
+			names:   []string{"web01.example.com", "payments.example.com"},
+			entity:  entity,
+		},
+		{
+			name:       "name of another entity",
+			profile:    CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.name}}.example.com"}},
+			names:      []string{"web02.example.com"},
+			entity:     entity,
+			violations: []string{"name web02.example.com is not bound to the identity of the caller (web01.example.com)"},
+		},
+		{
+			name:       "denied names are reported once in lower case",
+			profile:    CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.name}}.example.com"}},
+			names:      []string{"WEB02.example.com", "web02.EXAMPLE.com"},
+			entity:     entity,
+			violations: []string{"name web02.example.com is not bound to the identity of the caller (web01.example.com)"},
+		},
+		{
+			name:    "subdomain",
+			profile: CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.name}}.example.com"}, EntityBoundSubdomains: true},
+			names:   []string{"api.web01.example.com"},
+			entity:  entity,
+		},
+		{
+			name:       "subdomain without entity_bound_subdomains",
+			profile:    CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.name}}.example.com"}},
+			names:      []string{"api.web01.example.com"},
+			entity:     entity,
+			violations: []string{"name api.web01.example.com is not bound to the identity of the caller (web01.example.com)"},
+		},
+		{
+			name:       "suffix that is not a subdomain",
+			profile:    CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.name}}.example.com"}, EntityBoundSubdomains: true},
+			names:      []string{"xweb01.example.com"},
+			entity:     entity,
+			violations: []string{"name xweb01.example.com is not bound to the identity of the caller (web01.example.com)"},
+		},
+		{
+			name:    "wildcard under a bound name",
+			profile: CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.name}}.example.com"}, EntityBoundSubdomains: true},
+			names:   []string{"*.web01.example.com"},
+			entity:  entity,
+		},
+		{
+			name:       "wildcard covering a bound name",
+			profile:    CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.name}}.example.com"}, EntityBoundSubdomains: true},
+			names:      []string{"*.example.com"},
+			entity:     entity,
+			violations: []string{"name *.example.com is not bound to the identity of the caller (web01.example.com)"},
+		},
+		{
+			name:       "token without entity",
+			profile:    CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.name}}.example.com"}},
+			names:      []string{"web01.example.com"},
+			entity:     nil,
+			violations: []string{"the token has no identity entity to bind names to"},
+		},
+		{
+			name:    "unresolved templates bind no name",
+			profile: CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.metadata.missing}}.example.com", "{{identity.entity.name}}.example.com"}},
+			names:   []string{"web01.example.com"},
+			entity:  entity,
+		},
+		{
+			name:       "no template resolves",
+			profile:    CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.metadata.missing}}.example.com"}},
+			names:      []string{"web01.example.com"},
+			entity:     entity,
+			violations: []string{"no name could be resolved from the identity entity of the caller"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := tt.profile.checkEntityBinding(tt.names, tt.entity)
+			if !reflect.DeepEqual(violations, tt.violations) {
+				t.Errorf("checkEntityBinding() = %q, want %q", violations, tt.violations)
+			}
+		})
+	}
+}
+
+func TestCheckEntityBindingCSRNames(t *testing.T) {
+	entity := &identity.Entity{ID: "entity-1", Name: "web01"}
+	profile := CAGWConfigProfile{EntityBoundNames: []string{"{{identity.entity.name}}.example.com"}}
+	subjectVars := []SubjectVariable{{Type: "cn", Value: "web01.example.com"}}
+
+	tests := []struct {
+		name       string
+		csr        *x509.CertificateRequest
+		violations []string
+	}{
+		{
+			name: "bound CSR names",
+			csr: &x509.CertificateRequest{
+				Subject:  pkix.Name{CommonName: "web01.example.com"},
+				DNSNames: []string{"WEB01.example.com"},
+			},
+		},
+		{
+			name: "common name only in the CSR",
+			csr: &x509.CertificateRequest{
+				Subject: pkix.Name{CommonName: "web02.example.com"},
+			},
+			violations: []string{"name web02.example.com is not bound to the identity of the caller (web01.example.com)"},
+		},
+		{
+			name: "DNS SAN only in the CSR",
+			csr: &x509.CertificateRequest{
+				DNSNames: []string{"web02.example.com"},
+			},
+			violations: []string{"name web02.example.com is not bound to the identity of the caller (web01.example.com)"},
+		},
+		{
+			name: "person common name in the CSR is not bound",
+			csr: &x509.CertificateRequest{
+				Subject: pkix.Name{CommonName: "John Smith"},
+			},
+		},
+		{
+			name: "email SANs are not bound",
+			csr: &x509.CertificateRequest{
+				EmailAddresses: []string{"admin@example.org"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allVars, allAltNames := profile.withCSRNames(subjectVars, nil, tt.csr)
+			violations := profile.checkEntityBinding(profile.domainNames(allVars, allAltNames), entity)
+			if !reflect.DeepEqual(violations, tt.violations) {
+				t.Errorf("checkEntityBinding() = %q, want %q", violations, tt.violations)
+			}
+		})
+	}
+}
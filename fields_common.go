@@ -15,7 +15,9 @@ func addIssueAndSignCommonFields(fields map[string]*framework.FieldSchema) map[s
 		Description: `Format for returned data. Can be "pem", "der",
 or "pem_bundle". If "pem_bundle" any private
 key and issuing cert will be appended to the
-certificate pem. Defaults to "pem".`,
+certificate pem. The issue endpoint also supports
+"pkcs12", which returns a base64 encoded PKCS#12
+protected with "pkcs12_password". Defaults to "pem".`,
 	}
 
 	fields["subject_variables"] = &framework.FieldSchema{
@@ -28,17 +30,75 @@ configuration.`,
 	fields["alt_names"] = &framework.FieldSchema{
 		Type: framework.TypeCommaStringSlice,
 		Description: `The requested Subject Alternative Names (SAN), if any,
-in a comma-delimited list. Each SAN must have the type and value separated by the
-equal sign.`,
+in a comma-delimited list. Each SAN has the type and value separated by the
+equal sign. A SAN without a type is a DNS name, or an email address if it
+contains an @, as for the Vault PKI engine.`,
+	}
+
+	fields["common_name"] = &framework.FieldSchema{
+		Type: framework.TypeString,
+		Description: `The requested common name, as for the Vault PKI engine. It is
+mapped to the common name subject variable of the profile and, unless
+exclude_cn_from_sans is set, added as a DNS or email SAN if it is a hostname
+or an email address and the profile accepts that SAN type.`,
+	}
+
+	fields["exclude_cn_from_sans"] = &framework.FieldSchema{
+		Type:        framework.TypeBool,
+		Description: `If true, the common_name is not added as a SAN.`,
+	}
+
+	fields["ip_sans"] = &framework.FieldSchema{
+		Type:        framework.TypeCommaStringSlice,
+		Description: `The requested IP SANs, if any, in a comma-delimited list.`,
+	}
+
+	fields["uri_sans"] = &framework.FieldSchema{
+		Type:        framework.TypeCommaStringSlice,
+		Description: `The requested URI SANs, if any, in a comma-delimited list.`,
+	}
+
+	fields["other_sans"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: `The requested other SANs, if any, in a comma-delimited list
+in the format <oid>;UTF8:<value>.`,
+	}
+
+	fields["enrollment_options"] = &framework.FieldSchema{
+		Type: framework.TypeKVPairs,
+		Description: `Further fields of the CAGW enrollment request, keyed by name or
+by dotted path such as "optionalCertificateRequestDetails.<field>". Values that
+are JSON objects or arrays are sent as such, others as strings. Only the
+options the profile allows are accepted.`,
+	}
+
+	fields["response_mode"] = &framework.FieldSchema{
+		Type: framework.TypeString,
+		Description: `Fields to return: "default" or "pki", which adds the response
+fields of the Vault PKI engine. Defaults to the response mode of the role.`,
 	}
 
 	fields["ttl"] = &framework.FieldSchema{
 		Type: framework.TypeDurationSecond,
 		Description: `The requested Time To Live for the certificate;
 sets the expiration date. If not specified
-the role default, backend default, or system
-default TTL is used, in that order. Cannot
-be larger than the role max TTL.`,
+the profile default, mount default, or system
+default TTL is used, in that order. Capped by
+the profile max TTL and the mount or system
+max lease TTL.`,
+	}
+
+	fields["not_after"] = &framework.FieldSchema{
+		Type: framework.TypeString,
+		Description: `The expiration date of the certificate, in RFC 3339 format such
+as "2020-12-31T23:59:59Z". Cannot be combined with ttl or be beyond the max TTL
+of the profile.`,
+	}
+
+	fields["not_before_duration"] = &framework.FieldSchema{
+		Type: framework.TypeDurationSecond,
+		Description: `How far to backdate the start of the validity of the
+certificate, to allow for clock skew. It counts toward the max TTL.`,
 	}
 
 	fields["profile"] = &framework.FieldSchema{
@@ -66,12 +126,162 @@ func addConfigProfileCommonFields(fields map[string]*framework.FieldSchema) map[
 		Type: framework.TypeDurationSecond,
 		Description: "The lease duration if no specific lease duration is requested. " +
 			"The lease duration controls the expiration of certificates issued by this " +
-			"backend. Defaults to the value of max_ttl.",
+			"backend. Defaults to the default lease TTL of the mount.",
 	}
 
 	fields["max_ttl"] = &framework.FieldSchema{
 		Type:        framework.TypeDurationSecond,
-		Description: "The maximum allowed lease duration",
+		Description: "The maximum allowed lease duration. Capped by the mount or system max lease TTL.",
+	}
+
+	fields["refresh_interval"] = &framework.FieldSchema{
+		Type: framework.TypeDurationSecond,
+		Description: "How often the profile properties are refreshed from CAGW. " +
+			"If not set the profile is only refreshed on request.",
+	}
+
+	fields["allowed_key_types"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: `Key types that can be used with the profile, for CSRs and keys
+generated locally on issue: "rsa", "ec" or "ed25519". If not set all key types
+are allowed.`,
+	}
+
+	fields["min_rsa_bits"] = &framework.FieldSchema{
+		Type:    framework.TypeInt,
+		Default: defaultMinRSABits,
+		Description: `Minimum size of RSA keys used with the profile. Defaults to
+2048, set a lower value to accept smaller keys.`,
+	}
+
+	fields["allowed_ec_curves"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: `EC curves that can be used with the profile: "P-256", "P-384" or
+"P-521". If not set all curves are allowed.`,
+	}
+
+	fields["allowed_signature_algorithms"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: `Signature algorithms that CSRs can be signed with, for example
+"SHA256-RSA", "ECDSA-SHA256" or "Ed25519". If not set all algorithms are allowed.`,
+	}
+
+	fields["common_name_variable"] = &framework.FieldSchema{
+		Type: framework.TypeString,
+		Description: `The subject variable the common_name of a request maps to.
+Defaults to "cn".`,
+	}
+
+	fields["san_types"] = &framework.FieldSchema{
+		Type: framework.TypeKVPairs,
+		Description: `The CAGW SAN types that the SANs of Vault PKI style requests
+map to, keyed by "dns", "email", "ip", "uri" and "other". Defaults to "dNSName",
+"rfc822Name", "iPAddress", "uniformResourceIdentifier" and "otherName".`,
+	}
+
+	fields["use_csr_values"] = &framework.FieldSchema{
+		Type: framework.TypeBool,
+		Description: `If true, sign takes the subject variables and SANs that are not
+requested explicitly from the CSR. Requests can override it.`,
+	}
+
+	fields["allowed_domains"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: `The domains of the DNS names that can be requested, as DNS SANs
+or in the common name subject variable. Which names match is controlled by
+allow_subdomains, allow_glob_domains, allow_bare_domains and
+allow_wildcard_certificates. If not set any DNS name is allowed.`,
+	}
+
+	fields["allow_subdomains"] = &framework.FieldSchema{
+		Type:        framework.TypeBool,
+		Description: `If true, subdomains of the allowed_domains can be requested.`,
+	}
+
+	fields["allow_glob_domains"] = &framework.FieldSchema{
+		Type: framework.TypeBool,
+		Description: `If true, allowed_domains can contain glob patterns such as
+"ftp*.example.com".`,
+	}
+
+	fields["allow_bare_domains"] = &framework.FieldSchema{
+		Type:        framework.TypeBool,
+		Description: `If true, the allowed_domains themselves can be requested.`,
+	}
+
+	fields["allow_wildcard_certificates"] = &framework.FieldSchema{
+		Type: framework.TypeBool,
+		Description: `If true, wildcard names such as "*.example.com" can be requested
+when the name they cover is allowed.`,
+	}
+
+	fields["allowed_ip_cidrs"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: `The CIDR ranges that IP SANs must be in, for example
+"10.0.0.0/8". If not set any IP address is allowed.`,
+	}
+
+	fields["allowed_uri_sans"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: `Glob patterns that URI SANs must match, for example
+"spiffe://example.org/*". If not set any URI is allowed.`,
+	}
+
+	fields["allowed_email_domains"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: `The domains of the email addresses that can be requested as
+email SANs. If not set any email address is allowed.`,
+	}
+
+	fields["default_subject_variables"] = &framework.FieldSchema{
+		Type: framework.TypeString,
+		Description: `Subject variables added to requests that do not set them, in the
+format of subject_variables. Values can use identity templates such as
+{{identity.entity.name}}.`,
+	}
+
+	fields["fixed_subject_variables"] = &framework.FieldSchema{
+		Type: framework.TypeString,
+		Description: `Subject variables added to every request, in the format of
+subject_variables. Requests cannot set them to other values. Values can use
+identity templates.`,
+	}
+
+	fields["default_alt_names"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: `SANs added to requests, in the format of alt_names, unless the
+request already has them. Values can use identity templates.`,
+	}
+
+	fields["fixed_alt_names"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: `SANs added to every request, in the format of alt_names. Values
+can use identity templates.`,
+	}
+
+	fields["entity_bound_names"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: `Identity templates for the names a caller can request, for example
+"{{identity.entity.aliases.<mount accessor>.metadata.service_account_name}}.example.com".
+If set, the common name and every DNS SAN must equal one of the resolved names,
+otherwise the request is denied.`,
+	}
+
+	fields["entity_bound_subdomains"] = &framework.FieldSchema{
+		Type:        framework.TypeBool,
+		Description: `If true, names under the entity_bound_names are allowed too.`,
+	}
+
+	fields["allowed_enrollment_options"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: `The enrollment_options that requests can set, by name or dotted
+path. Globs can be used. If not set no enrollment options can be requested.`,
+	}
+
+	fields["fixed_enrollment_options"] = &framework.FieldSchema{
+		Type: framework.TypeKVPairs,
+		Description: `Enrollment options sent with every request. Requests cannot set
+them to other values.`,
 	}
 
 	fields["roleName"] = &framework.FieldSchema{
@@ -81,3 +291,103 @@ func addConfigProfileCommonFields(fields map[string]*framework.FieldSchema) map[
 
 	return fields
 }
+
+func addConnectionCommonFields(fields map[string]*framework.FieldSchema) map[string]*framework.FieldSchema {
+
+	fields["pem_bundle"] = &framework.FieldSchema{
+		Type:    framework.TypeString,
+		Default: "",
+		Description: "PEM encoded client certificate and key. The key may be an " +
+			"encrypted PKCS#8 key, in which case key_password must be provided. " +
+			"Required unless pkcs12 is provided. Write-only, reads only tell whether it is set.",
+	}
+
+	fields["key_password"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Default:     "",
+		Description: `Passphrase for an encrypted PKCS#8 private key in pem_bundle. Write-only.`,
+	}
+
+	fields["pkcs12"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Default:     "",
+		Description: `Base64 encoded PKCS#12 holding the client certificate and key. Write-only, reads only tell whether it is set.`,
+	}
+
+	fields["pkcs12_password"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Default:     "",
+		Description: `Password protecting the pkcs12 client credentials. Write-only.`,
+	}
+
+	fields["url"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Default:     "",
+		Description: `URL for CAGW including base context path`,
+	}
+
+	fields["urls"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: "Ordered list of CAGW URLs including base context path. CA and " +
+			"profile lookups fail over to the next URL on connection errors and 5xx " +
+			"responses. Enrollments only fail over when the request could not be " +
+			"sent and never on 5xx responses. Cannot be combined with url.",
+	}
+
+	fields["failover_cooldown"] = &framework.FieldSchema{
+		Type: framework.TypeDurationSecond,
+		Description: "How long a CAGW URL that failed is skipped before it is tried " +
+			"again. Defaults to 60 seconds.",
+	}
+
+	fields["cacerts"] = &framework.FieldSchema{
+		Type:    framework.TypeString,
+		Default: "",
+		Description: "PEM encoded CA certificate chain. Not needed if the gateway's " +
+			"certificate is publicly trusted.",
+	}
+
+	fields["connect_timeout"] = &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "Timeout for establishing the connection to CAGW. Defaults to 30 seconds.",
+	}
+
+	fields["tls_handshake_timeout"] = &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "Timeout for the TLS handshake with CAGW. Defaults to 10 seconds.",
+	}
+
+	fields["request_timeout"] = &framework.FieldSchema{
+		Type: framework.TypeDurationSecond,
+		Description: "Overall timeout for a request to CAGW, including reading the " +
+			"response. Defaults to 60 seconds.",
+	}
+
+	fields["proxy_url"] = &framework.FieldSchema{
+		Type:    framework.TypeString,
+		Default: "",
+		Description: `URL of the proxy to connect to CAGW through. If "none" no proxy is
+used. Defaults to the proxy from the environment.`,
+	}
+
+	fields["tls_min_version"] = &framework.FieldSchema{
+		Type:    framework.TypeString,
+		Default: "",
+		Description: `Minimum TLS version to use with CAGW. Can be "tls10", "tls11",
+"tls12" or "tls13".`,
+	}
+
+	fields["cipher_suites"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: "Cipher suites allowed with CAGW, using the IANA names such as " +
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Does not apply to TLS 1.3.",
+	}
+
+	fields["tls_server_name"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Default:     "",
+		Description: "Server name to send with SNI and to verify the CAGW certificate against.",
+	}
+
+	return fields
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ryanuber/go-glob"
+)
+
+// domainNames returns the DNS names of a request that the domain policy of the
+// profile applies to: the values of the common name subject variable that are
+// hostnames, the same way they are copied to a DNS SAN, and the DNS SANs.
+// Other common names, such as email addresses or the name of a person, are not
+// DNS names.
+func (p *CAGWConfigProfile) domainNames(subjectVars []SubjectVariable, altNames []SubjectAltName) []string {
+	var names []string
+	for _, v := range subjectVars {
+		if strings.EqualFold(v.Type, p.commonNameVariable()) && isHostname(v.Value) {
+			names = append(names, v.Value)
+		}
+	}
+	dnsType := p.sanType(sanKindDNS)
+	for _, a := range altNames {
+		if strings.EqualFold(a.Type, dnsType) {
+			names = append(names, a.Value)
+		}
+	}
+	return names
+}
+
+// withCSRNames returns the subject variables and SANs of a request together
+// with the common name and the SANs of its CSR, so that the name policy and
+// the entity binding apply to the names of the CSR on sign whether or not
+// they are mapped onto the request. The given slices are not modified.
+func (p *CAGWConfigProfile) withCSRNames(subjectVars []SubjectVariable, altNames []SubjectAltName, csr *x509.CertificateRequest) ([]SubjectVariable, []SubjectAltName) {
+	subjectVars = append([]SubjectVariable{}, subjectVars...)
+	altNames = append([]SubjectAltName{}, altNames...)
+
+	if len(csr.Subject.CommonName) > 0 {
+		subjectVars = append(subjectVars, SubjectVariable{Type: p.commonNameVariable(), Value: csr.Subject.CommonName})
+	}
+
+	for _, name := range csr.DNSNames {
+		altNames = append(altNames, SubjectAltName{Type: p.sanType(sanKindDNS), Value: name})
+	}
+	for _, email := range csr.EmailAddresses {
+		altNames = append(altNames, SubjectAltName{Type: p.sanType(sanKindEmail), Value: email})
+	}
+	for _, ip := range csr.IPAddresses {
+		altNames = append(altNames, SubjectAltName{Type: p.sanType(sanKindIP), Value: ip.String()})
+	}
+	for _, uri := range csr.URIs {
+		altNames = append(altNames, SubjectAltName{Type: p.sanType(sanKindURI), Value: uri.String()})
+	}
+	return subjectVars, altNames
+}
+
+// checkNamePolicy applies the domain, IP, URI and email policies of the
+// profile to the names of a request and returns every violation.
+func (p *CAGWConfigProfile) checkNamePolicy(subjectVars []SubjectVariable, altNames []SubjectAltName) []string {
+	violations := p.checkDomains(p.domainNames(subjectVars, altNames))
+	return append(violations, p.checkSANPolicy(altNames)...)
+}
+
+// checkDomains validates DNS names against the allowed domains of the profile
+// and returns every violation. Any name is allowed if the profile does not
+// list allowed domains.
+func (p *CAGWConfigProfile) checkDomains(names []string) []string {
+	var violations []string
+	if len(p.AllowedDomains) == 0 {
+		return violations
+	}
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if !p.domainAllowed(name) {
+			violations = append(violations, fmt.Sprintf("DNS name %s is not allowed by the profile", name))
+		}
+	}
+	return violations
+}
+
+// domainAllowed applies the domain policy of the profile to a single name,
+// following the semantics of the Vault PKI engine roles. A wildcard is only
+// accepted as the whole leftmost label.
+func (p *CAGWConfigProfile) domainAllowed(name string) bool {
+	isWildcard := strings.HasPrefix(name, "*.")
+	if isWildcard && !p.AllowWildcardCertificates {
+		return false
+	}
+	baseName := strings.TrimPrefix(name, "*.")
+	if strings.Contains(baseName, "*") {
+		return false
+	}
+
+	for _, domain := range p.AllowedDomains {
+		domain = strings.ToLower(domain)
+
+		if p.AllowBareDomains && !isWildcard && baseName == domain {
+			return true
+		}
+		if p.AllowSubdomains {
+			if strings.HasSuffix(baseName, "."+domain) || (isWildcard && baseName == domain) {
+				return true
+			}
+		}
+		if p.AllowGlobDomains && strings.Contains(domain, "*") && glob.Glob(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSANPolicy validates the IP, URI and email SANs against the allowed CIDR
+// ranges, URI patterns and email domains of the profile and returns every
+// violation. Each policy allows any value if it is not set.
+func (p *CAGWConfigProfile) checkSANPolicy(altNames []SubjectAltName) []string {
+	var violations []string
+
+	seen := map[SubjectAltName]bool{}
+	for _, a := range altNames {
+		if seen[a] {
+			continue
+		}
+		seen[a] = true
+
+		switch {
+		case strings.EqualFold(a.Type, p.sanType(sanKindIP)) && len(p.AllowedIPCIDRs) > 0:
+			ip := net.ParseIP(a.Value)
+			if ip == nil {
+				violations = append(violations, fmt.Sprintf("IP SAN %s is not a valid IP address", a.Value))
+			} else if !p.ipAllowed(ip) {
+				violations = append(violations, fmt.Sprintf("IP SAN %s is not in the allowed CIDR ranges %s of the profile", a.Value, strings.Join(p.AllowedIPCIDRs, ", ")))
+			}
+
+		case strings.EqualFold(a.Type, p.sanType(sanKindURI)) && len(p.AllowedURISANs) > 0:
+			if !p.uriAllowed(a.Value) {
+				violations = append(violations, fmt.Sprintf("URI SAN %s does not match the allowed URI patterns %s of the profile", a.Value, strings.Join(p.AllowedURISANs, ", ")))
+			}
+
+		case strings.EqualFold(a.Type, p.sanType(sanKindEmail)) && len(p.AllowedEmailDomains) > 0:
+			at := strings.LastIndex(a.Value, "@")
+			if at < 0 {
+				violations = append(violations, fmt.Sprintf("email SAN %s is not a valid email address", a.Value))
+			} else if !p.emailDomainAllowed(a.Value[at+1:]) {
+				violations = append(violations, fmt.Sprintf("email SAN %s is not in the allowed email domains %s of the profile", a.Value, strings.Join(p.AllowedEmailDomains, ", ")))
+			}
+		}
+	}
+	return violations
+}
+
+func (p *CAGWConfigProfile) ipAllowed(ip net.IP) bool {
+	for _, cidr := range p.AllowedIPCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CAGWConfigProfile) uriAllowed(uri string) bool {
+	for _, pattern := range p.AllowedURISANs {
+		if glob.Glob(pattern, uri) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CAGWConfigProfile) emailDomainAllowed(domain string) bool {
+	for _, allowed := range p.AllowedEmailDomains {
+		if strings.EqualFold(allowed, domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestDomainAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile CAGWConfigProfile
+		domain  string
+		allowed bool
+	}{
+		{
+			name:    "subdomain",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowSubdomains: true},
+			domain:  "www.example.com",
+			allowed: true,
+		},
+		{
+			name:    "nested subdomain",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowSubdomains: true},
+			domain:  "a.b.example.com",
+			allowed: true,
+		},
+		{
+			name:    "subdomain without allow_subdomains",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowBareDomains: true},
+			domain:  "www.example.com",
+			allowed: false,
+		},
+		{
+			name:    "suffix that is not a subdomain",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowSubdomains: true},
+			domain:  "badexample.com",
+			allowed: false,
+		},
+		{
+			name:    "bare domain",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowBareDomains: true},
+			domain:  "example.com",
+			allowed: true,
+		},
+		{
+			name:    "bare domain without allow_bare_domains",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowSubdomains: true},
+			domain:  "example.com",
+			allowed: false,
+		},
+		{
+			name:    "allowed domain in upper case",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"Example.COM"}, AllowSubdomains: true},
+			domain:  "www.example.com",
+			allowed: true,
+		},
+		{
+			name:    "wildcard",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowSubdomains: true, AllowWildcardCertificates: true},
+			domain:  "*.example.com",
+			allowed: true,
+		},
+		{
+			name:    "wildcard under a subdomain",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowSubdomains: true, AllowWildcardCertificates: true},
+			domain:  "*.www.example.com",
+			allowed: true,
+		},
+		{
+			name:    "wildcard without allow_wildcard_certificates",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowSubdomains: true},
+			domain:  "*.example.com",
+			allowed: false,
+		},
+		{
+			name:    "wildcard of a bare domain",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowBareDomains: true, AllowWildcardCertificates: true},
+			domain:  "*.example.com",
+			allowed: false,
+		},
+		{
+			name:    "wildcard in an inner label",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowSubdomains: true, AllowWildcardCertificates: true},
+			domain:  "a.*.example.com",
+			allowed: false,
+		},
+		{
+			name:    "partial wildcard label",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowSubdomains: true, AllowWildcardCertificates: true},
+			domain:  "f*.example.com",
+			allowed: false,
+		},
+		{
+			name:    "double wildcard",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"example.com"}, AllowSubdomains: true, AllowWildcardCertificates: true},
+			domain:  "*.*.example.com",
+			allowed: false,
+		},
+		{
+			name:    "glob domain",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"web-*.example.com"}, AllowGlobDomains: true},
+			domain:  "web-01.example.com",
+			allowed: true,
+		},
+		{
+			name:    "glob domain that does not match",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"web-*.example.com"}, AllowGlobDomains: true},
+			domain:  "db-01.example.com",
+			allowed: false,
+		},
+		{
+			name:    "glob domain without allow_glob_domains",
+			profile: CAGWConfigProfile{AllowedDomains: []string{"web-*.example.com"}, AllowSubdomains: true},
+			domain:  "web-01.example.com",
+			allowed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allowed := tt.profile.domainAllowed(tt.domain); allowed != tt.allowed {
+				t.Errorf("domainAllowed(%q) = %v, want %v", tt.domain, allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestCheckNamePolicy(t *testing.T) {
+	profile := CAGWConfigProfile{
+		AllowedDomains:      []string{"example.com"},
+		AllowSubdomains:     true,
+		AllowedIPCIDRs:      []string{"10.0.0.0/8"},
+		AllowedURISANs:      []string{"spiffe://example.com/*"},
+		AllowedEmailDomains: []string{"example.com"},
+	}
+
+	tests := []struct {
+		name        string
+		subjectVars []SubjectVariable
+		altNames    []SubjectAltName
+		violations  []string
+	}{
+		{
+			name:        "allowed names",
+			subjectVars: []SubjectVariable{{Type: "cn", Value: "www.example.com"}},
+			altNames: []SubjectAltName{
+				{Type: "dNSName", Value: "api.example.com"},
+				{Type: "iPAddress", Value: "10.1.2.3"},
+				{Type: "uniformResourceIdentifier", Value: "spiffe://example.com/web"},
+				{Type: "rfc822Name", Value: "admin@example.com"},
+			},
+		},
+		{
+			name:        "names in upper case are folded",
+			subjectVars: []SubjectVariable{{Type: "CN", Value: "WWW.Example.COM"}},
+			altNames: []SubjectAltName{
+				{Type: "DNSNAME", Value: "API.EXAMPLE.COM"},
+				{Type: "rfc822Name", Value: "admin@EXAMPLE.com"},
+			},
+		},
+		{
+			name:        "denied common name",
+			subjectVars: []SubjectVariable{{Type: "cn", Value: "www.example.org"}},
+			violations:  []string{"DNS name www.example.org is not allowed by the profile"},
+		},
+		{
+			name:        "denied names are reported once in lower case",
+			subjectVars: []SubjectVariable{{Type: "cn", Value: "WWW.example.org"}},
+			altNames:    []SubjectAltName{{Type: "dNSName", Value: "www.EXAMPLE.org"}},
+			violations:  []string{"DNS name www.example.org is not allowed by the profile"},
+		},
+		{
+			name:        "email common name is not a DNS name",
+			subjectVars: []SubjectVariable{{Type: "cn", Value: "admin@example.org"}},
+		},
+		{
+			name:        "person common name is not a DNS name",
+			subjectVars: []SubjectVariable{{Type: "cn", Value: "John Smith"}},
+		},
+		{
+			name:        "other subject variables are not DNS names",
+			subjectVars: []SubjectVariable{{Type: "o", Value: "Example Org"}},
+		},
+		{
+			name: "denied SANs",
+			altNames: []SubjectAltName{
+				{Type: "dNSName", Value: "a.*.example.com"},
+				{Type: "iPAddress", Value: "192.168.1.1"},
+				{Type: "iPAddress", Value: "not-an-ip"},
+				{Type: "uniformResourceIdentifier", Value: "spiffe://example.org/web"},
+				{Type: "rfc822Name", Value: "admin@example.org"},
+				{Type: "rfc822Name", Value: "admin"},
+			},
+			violations: []string{
+				"DNS name a.*.example.com is not allowed by the profile",
+				"IP SAN 192.168.1.1 is not in the allowed CIDR ranges 10.0.0.0/8 of the profile",
+				"IP SAN not-an-ip is not a valid IP address",
+				"URI SAN spiffe://example.org/web does not match the allowed URI patterns spiffe://example.com/* of the profile",
+				"email SAN admin@example.org is not in the allowed email domains example.com of the profile",
+				"email SAN admin is not a valid email address",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := profile.checkNamePolicy(tt.subjectVars, tt.altNames)
+			if !reflect.DeepEqual(violations, tt.violations) {
+				t.Errorf("checkNamePolicy() = %q, want %q", violations, tt.violations)
+			}
+		})
+	}
+}
+
+func TestCheckNamePolicyWithoutPolicy(t *testing.T) {
+	var profile CAGWConfigProfile
+	violations := profile.checkNamePolicy(
+		[]SubjectVariable{{Type: "cn", Value: "John Smith"}},
+		[]SubjectAltName{
+			{Type: "dNSName", Value: "*.example.org"},
+			{Type: "iPAddress", Value: "192.168.1.1"},
+			{Type: "uniformResourceIdentifier", Value: "https://example.org"},
+			{Type: "rfc822Name", Value: "admin@example.org"},
+		})
+	if len(violations) != 0 {
+		t.Errorf("checkNamePolicy() = %q, want no violations", violations)
+	}
+}
+
+func TestCheckNamePolicyCSRNames(t *testing.T) {
+	profile := CAGWConfigProfile{
+		AllowedDomains:      []string{"example.com"},
+		AllowSubdomains:     true,
+		AllowedIPCIDRs:      []string{"10.0.0.0/8"},
+		AllowedURISANs:      []string{"spiffe://example.com/*"},
+		AllowedEmailDomains: []string{"example.com"},
+	}
+	uri, _ := url.Parse("spiffe://example.org/web")
+
+	tests := []struct {
+		name       string
+		csr        *x509.CertificateRequest
+		violations []string
+	}{
+		{
+			name: "allowed CSR names",
+			csr: &x509.CertificateRequest{
+				Subject:  pkix.Name{CommonName: "www.example.com"},
+				DNSNames: []string{"api.example.com"},
+			},
+		},
+		{
+			name: "common name only in the CSR",
+			csr: &x509.CertificateRequest{
+				Subject: pkix.Name{CommonName: "www.example.org"},
+			},
+			violations: []string{"DNS name www.example.org is not allowed by the profile"},
+		},
+		{
+			name: "SANs only in the CSR",
+			csr: &x509.CertificateRequest{
+				DNSNames:       []string{"api.example.org"},
+				IPAddresses:    []net.IP{net.ParseIP("192.168.1.1")},
+				URIs:           []*url.URL{uri},
+				EmailAddresses: []string{"admin@example.org"},
+			},
+			violations: []string{
+				"DNS name api.example.org is not allowed by the profile",
+				"email SAN admin@example.org is not in the allowed email domains example.com of the profile",
+				"IP SAN 192.168.1.1 is not in the allowed CIDR ranges 10.0.0.0/8 of the profile",
+				"URI SAN spiffe://example.org/web does not match the allowed URI patterns spiffe://example.com/* of the profile",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subjectVars := []SubjectVariable{{Type: "cn", Value: "www.example.com"}}
+			altNames := []SubjectAltName{{Type: "dNSName", Value: "www.example.com"}}
+
+			allVars, allAltNames := profile.withCSRNames(subjectVars, altNames, tt.csr)
+			violations := profile.checkNamePolicy(allVars, allAltNames)
+			if !reflect.DeepEqual(violations, tt.violations) {
+				t.Errorf("checkNamePolicy() = %q, want %q", violations, tt.violations)
+			}
+
+			if len(subjectVars) != 1 || len(altNames) != 1 {
+				t.Errorf("withCSRNames modified the names of the request: %v, %v", subjectVars, altNames)
+			}
+		})
+	}
+}
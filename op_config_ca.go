@@ -8,8 +8,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
+
 	"github.com/pkg/errors"
 
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
@@ -19,9 +22,11 @@ func (b *backend) opWriteConfigRole(ctx context.Context, req *logical.Request, d
 	roleName := data.Get("roleName").(string)
 	caId := data.Get("ca_id").(string)
 	profileId := data.Get("profile_id").(string)
-	certPem := data.Get("pem_bundle").(string)
-	url := data.Get("url").(string)
-	caCertPem := data.Get("cacerts").(string)
+	allowedProfiles := data.Get("allowed_profiles").([]string)
+	defaultProfile := data.Get("default_profile").(string)
+	responseMode := data.Get("response_mode").(string)
+	connectionName := data.Get("connection").(string)
+	connection := connectionFromFieldData(data)
 
 	b.Logger().Info(fmt.Sprintf(`
 Configuring new CA role configuration
@@ -29,41 +34,60 @@ role name:  %s
 ca id:      %s
 profile id: %s
 url:        %s
+connection: %s
 `,
-		roleName, caId, profileId, url))
+		roleName, caId, profileId, strings.Join(connection.endpoints(), ", "), connectionName))
 
 	if len(roleName) == 0 {
 		return logical.ErrorResponse("must provide name for role configuration"), nil
 	}
-	if len(certPem) == 0 {
-		return logical.ErrorResponse("must provide PEM encoded certificate"), nil
-	}
 	if len(caId) == 0 {
 		caId = roleName
 	}
-	if len(url) == 0 {
-		return logical.ErrorResponse("must provide gateway URL"), nil
+	if len(profileId) > 0 && (len(allowedProfiles) > 0 || len(defaultProfile) > 0) {
+		return logical.ErrorResponse("profile_id cannot be combined with allowed_profiles or default_profile"), nil
 	}
-	if len(caCertPem) == 0 {
-		return logical.ErrorResponse("must provide gateway CA certificate"), nil
+	if len(responseMode) > 0 && !strutil.StrListContains(responseModes, responseMode) {
+		return logical.ErrorResponse("Invalid response mode: " + responseMode), nil
 	}
 
 	configCa := &CAGWConfigRole{
-		certPem,
-		url,
-		caCertPem,
-		caId,
-		profileId,
+		CAId:            caId,
+		ProfileId:       profileId,
+		AllowedProfiles: allowedProfiles,
+		DefaultProfile:  defaultProfile,
+		ResponseMode:    responseMode,
+	}
+
+	// The gateway settings are either given inline or taken from a named
+	// connection; only inline settings are stored with the role.
+	resolved := *configCa
+	if len(connectionName) > 0 {
+		if !connection.isEmpty() {
+			return logical.ErrorResponse("connection cannot be combined with inline gateway settings"), nil
+		}
+		storedConnection, err := getConnection(ctx, req.Storage, connectionName)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		configCa.Connection = connectionName
+		resolved.CAGWConnection = *storedConnection
+	} else {
+		if err := connection.validate(); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		configCa.CAGWConnection = *connection
+		resolved.CAGWConnection = *connection
 	}
 
-	profiles, err := configCa.ProfileIDs(ctx, req, data, caId)
+	profiles, err := resolved.ProfileIDs(ctx, req, data, caId)
 	if err != nil {
 		return logical.ErrorResponse("error fetching profile configurations from CAGW: " + err.Error()), err
 	}
 
 	caAndProfiles := CAGWConfigCAConfigProfileIDs{
-		*configCa,
-		profiles,
+		CAGWConfigRole: *configCa,
+		Profiles:       profiles,
 	}
 
 	if len(profileId) > 0 {
@@ -73,10 +97,23 @@ url:        %s
 		}
 		caAndProfiles.Profiles = []CAGWConfigProfileID{*profile}
 	} else {
-		caAndProfiles.Profiles = profiles
+		caAndProfiles.Profiles = nil
+		for _, p := range profiles {
+			if configCa.profileAllowed(p.Id) {
+				caAndProfiles.Profiles = append(caAndProfiles.Profiles, p)
+			}
+		}
+		if len(allowedProfiles) > 0 && len(caAndProfiles.Profiles) == 0 {
+			return logical.ErrorResponse("No profile of CA " + caId + " matches the allowed profiles"), nil
+		}
+		if len(defaultProfile) > 0 {
+			if _, err := findProfile(caAndProfiles.Profiles, defaultProfile); err != nil {
+				return logical.ErrorResponse("Default profile " + defaultProfile + " is not an allowed profile of CA " + caId), nil
+			}
+		}
 	}
 
-	storageEntry, err := logical.StorageEntryJSON("config/"+roleName, caAndProfiles)
+	storageEntry, err := configRoleStorageEntry(roleName, &caAndProfiles)
 
 	if err != nil {
 		return logical.ErrorResponse("error creating config storage entry: " + err.Error()), err
@@ -91,7 +128,13 @@ url:        %s
 		"Message":  "Configuration successful",
 		"RoleName": roleName,
 		"CaId":     caId,
-		"URL":      url,
+		"URL":      resolved.URL,
+	}
+	if len(resolved.URLs) > 0 {
+		respData["URLs"] = resolved.URLs
+	}
+	if len(configCa.Connection) > 0 {
+		respData["Connection"] = configCa.Connection
 	}
 
 	return &logical.Response{
@@ -103,17 +146,28 @@ func (b *backend) opReadConfigRole(ctx context.Context, req *logical.Request, da
 
 	roleName := data.Get("roleName").(string)
 
-	storageEntry, err := req.Storage.Get(ctx, "config/"+roleName)
-	if err != nil {
-		return logical.ErrorResponse("could not read configuration: " + err.Error()), err
-	}
-
-	var rawData map[string]interface{}
-	err = storageEntry.DecodeJSON(&rawData)
-
+	configRole, err := getStoredConfigRole(ctx, req.Storage, roleName)
 	if err != nil {
-		return logical.ErrorResponse("json decoding failed: " + err.Error()), err
-	}
+		return logical.ErrorResponse("could not read configuration: " + err.Error()), nil
+	}
+
+	var profiles []map[string]interface{}
+	for _, p := range configRole.Profiles {
+		profiles = append(profiles, map[string]interface{}{
+			"Id":   p.Id,
+			"Name": p.Name,
+		})
+	}
+
+	// The response keeps the field names of the original storage layout
+	rawData := connectionResponseData(&configRole.CAGWConnection)
+	rawData["Connection"] = configRole.Connection
+	rawData["CAId"] = configRole.CAId
+	rawData["ProfileId"] = configRole.ProfileId
+	rawData["AllowedProfiles"] = configRole.AllowedProfiles
+	rawData["DefaultProfile"] = configRole.DefaultProfile
+	rawData["ResponseMode"] = configRole.ResponseMode
+	rawData["Profiles"] = profiles
 
 	resp := &logical.Response{
 		Data: rawData,
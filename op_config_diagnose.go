@@ -0,0 +1,231 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+)
+
+const (
+	diagnoseStatusOK      = "ok"
+	diagnoseStatusFailed  = "failed"
+	diagnoseStatusSkipped = "skipped"
+)
+
+func (b *backend) opReadConfigDiagnose(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	roleName := data.Get("roleName").(string)
+
+	configRole, err := getConfigRole(ctx, req, roleName)
+	if err != nil {
+		return logical.ErrorResponse("Error fetching config: " + err.Error()), nil
+	}
+
+	caId := configRole.CAId
+	if len(caId) <= 0 {
+		caId = roleName
+	}
+
+	var steps []map[string]interface{}
+	success := true
+
+	// Each check only runs when the previous checks of its chain succeeded;
+	// the failing check and everything after it are reported so the cause is
+	// obvious. Every gateway endpoint is checked in a chain of its own.
+	run := func(name string, endpoint string, failed *bool, check func() (string, error)) {
+		step := map[string]interface{}{
+			"Name":   name,
+			"Status": diagnoseStatusSkipped,
+		}
+		if len(endpoint) > 0 {
+			step["Endpoint"] = endpoint
+		}
+		if *failed {
+			steps = append(steps, step)
+			return
+		}
+		start := time.Now()
+		message, err := check()
+		step["Status"] = diagnoseStatusOK
+		step["Duration"] = time.Since(start).String()
+		step["Message"] = message
+		if err != nil {
+			*failed = true
+			success = false
+			step["Status"] = diagnoseStatusFailed
+			step["Message"] = err.Error()
+		}
+		steps = append(steps, step)
+	}
+
+	var tlsClientConfig *tls.Config
+	var client *http.Client
+	configFailed := false
+	run("client_configuration", "", &configFailed, func() (string, error) {
+		tlsClientConfig, err = getTLSConfig(ctx, req, configRole)
+		if err != nil {
+			return "", fmt.Errorf("Error retrieving TLS configuration: %w", err)
+		}
+		client, err = configRole.httpClient(tlsClientConfig)
+		if err != nil {
+			return "", err
+		}
+		return "client certificate and trust settings loaded", nil
+	})
+
+	reachable := false
+	for _, endpoint := range configRole.endpoints() {
+		endpoint := endpoint
+		failed := configFailed
+
+		run("resolve", endpoint, &failed, func() (string, error) {
+			gatewayURL, err := url.Parse(endpoint)
+			if err != nil {
+				return "", errors.Wrap(err, "invalid gateway URL")
+			}
+			host := gatewayURL.Hostname()
+			if ip := net.ParseIP(host); ip != nil {
+				return fmt.Sprintf("%s is an IP address", host), nil
+			}
+			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s resolved to %v", host, addrs), nil
+		})
+
+		run("tls_handshake", endpoint, &failed, func() (string, error) {
+			// Any request will do, only the outcome of the handshake matters. It
+			// goes through the configured client so proxies and timeouts apply.
+			var state *tls.ConnectionState
+			trace := &httptrace.ClientTrace{
+				TLSHandshakeDone: func(s tls.ConnectionState, err error) {
+					if err == nil {
+						state = &s
+					}
+				},
+			}
+			httpReq, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodHead, endpoint, nil)
+			if err != nil {
+				return "", err
+			}
+			resp, err := client.Do(httpReq)
+			if state == nil {
+				if err != nil {
+					return "", err
+				}
+				return "", errors.New("no TLS handshake took place")
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return fmt.Sprintf("negotiated %s with %s", tlsVersionName(state.Version), state.PeerCertificates[0].Subject), nil
+		})
+
+		var resp *http.Response
+		run("client_certificate", endpoint, &failed, func() (string, error) {
+			httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(endpoint, "/")+"/v1/certificate-authorities", nil)
+			if err != nil {
+				return "", err
+			}
+			resp, err = client.Do(httpReq)
+			if err != nil {
+				return "", err
+			}
+
+			if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+				resp.Body.Close()
+				return "", errors.Errorf("client certificate was rejected by the gateway (%d)", resp.StatusCode)
+			}
+			if resp.StatusCode != 200 {
+				resp.Body.Close()
+				return "", errors.Errorf("unexpected response from gateway (%d)", resp.StatusCode)
+			}
+			return "client certificate accepted", nil
+		})
+
+		// A response that breaks off is reported on its own rather than as a
+		// failed CA or profile lookup
+		run("read_response", endpoint, &failed, func() (string, error) {
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				return "", errors.Wrap(err, "the gateway response could not be read")
+			}
+			return fmt.Sprintf("read %d bytes", len(body)), nil
+		})
+
+		reachable = reachable || !failed
+	}
+
+	// The lookups go through failover like any other request, so they only
+	// need one working endpoint
+	unreachable := !reachable
+	failed := &unreachable
+	run("ca_lookup", "", failed, func() (string, error) {
+		caResp, err := configRole.getCertificateAuthority(ctx, tlsClientConfig, caId)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("found CA %s (%s)", caResp.CertificateAuthority.Id, caResp.CertificateAuthority.Name), nil
+	})
+
+	run("profile_lookup", "", failed, func() (string, error) {
+		// Check the profile requests would use by default, if there is one
+		if profileId, err := configRole.profileIdFor(""); err == nil {
+			profileResp, err := CAGWConfigProfileID{Id: profileId}.getProfile(ctx, tlsClientConfig, configRole, roleName)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("found profile %s (%s)", profileResp.Profile.Id, profileResp.Profile.Name), nil
+		}
+		profilesResp, err := configRole.getProfiles(ctx, tlsClientConfig, caId)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("found %d profiles for CA %s", len(profilesResp.Profiles), caId), nil
+	})
+
+	respData := map[string]interface{}{
+		"RoleName": roleName,
+		"CaId":     caId,
+		"URL":      configRole.URL,
+		"URLs":     configRole.endpoints(),
+		"Success":  success,
+		"Steps":    steps,
+	}
+
+	return &logical.Response{
+		Data: respData,
+	}, nil
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("TLS 0x%04x", version)
+}
@@ -8,7 +8,9 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
@@ -19,6 +21,65 @@ func (b *backend) opWriteConfigProfile(ctx context.Context, req *logical.Request
 
 	id := getProfileId(data)
 
+	for _, keyType := range data.Get("allowed_key_types").([]string) {
+		if !strutil.StrListContains(keyTypes, keyType) {
+			return logical.ErrorResponse("Invalid key type: " + keyType), nil
+		}
+	}
+	for _, curve := range data.Get("allowed_ec_curves").([]string) {
+		if !strutil.StrListContains(ecCurves, curve) {
+			return logical.ErrorResponse("Invalid EC curve: " + curve), nil
+		}
+	}
+	for _, algorithm := range data.Get("allowed_signature_algorithms").([]string) {
+		if !signatureAlgorithmKnown(algorithm) {
+			return logical.ErrorResponse("Invalid signature algorithm: " + algorithm), nil
+		}
+	}
+	if data.Get("min_rsa_bits").(int) < 0 {
+		return logical.ErrorResponse("min_rsa_bits cannot be negative"), nil
+	}
+	for _, cidr := range data.Get("allowed_ip_cidrs").([]string) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return logical.ErrorResponse("Invalid CIDR in allowed_ip_cidrs: " + cidr), nil
+		}
+	}
+	for kind := range data.Get("san_types").(map[string]string) {
+		if _, ok := defaultSANTypes[kind]; !ok {
+			return logical.ErrorResponse("Invalid SAN kind in san_types: " + kind), nil
+		}
+	}
+
+	for _, field := range []string{"default_subject_variables", "fixed_subject_variables"} {
+		if value := data.Get(field).(string); len(value) > 0 {
+			vars, err := processSubjectVariables(value)
+			if err != nil {
+				return logical.ErrorResponse("Invalid " + field + ": " + err.Error()), nil
+			}
+			for _, v := range vars {
+				if err := validateTemplate(v.Value); err != nil {
+					return logical.ErrorResponse("Invalid " + field + ": " + err.Error()), nil
+				}
+			}
+		}
+	}
+	for _, field := range []string{"default_alt_names", "fixed_alt_names", "entity_bound_names"} {
+		for _, name := range data.Get(field).([]string) {
+			if err := validateTemplate(name); err != nil {
+				return logical.ErrorResponse("Invalid " + field + ": " + err.Error()), nil
+			}
+		}
+	}
+
+	for _, key := range data.Get("allowed_enrollment_options").([]string) {
+		if err := validateEnrollmentOptionKey(key); err != nil {
+			return logical.ErrorResponse("Invalid allowed_enrollment_options: " + err.Error()), nil
+		}
+	}
+	if err := validateFixedEnrollmentOptions(data.Get("fixed_enrollment_options").(map[string]string)); err != nil {
+		return logical.ErrorResponse("Invalid fixed_enrollment_options: " + err.Error()), nil
+	}
+
 	profileId := CAGWConfigProfileID{id, ""}
 	profile, err := profileId.Profile(ctx, req, data)
 
@@ -26,7 +87,7 @@ func (b *backend) opWriteConfigProfile(ctx context.Context, req *logical.Request
 		return logical.ErrorResponse(fmt.Sprintf("Error retrieving the profile properties from CAGW: %s", err)), err
 	}
 
-	storageEntry, err := logical.StorageEntryJSON("config/"+roleName+"/profiles/"+profile.Id, profile)
+	storageEntry, err := configProfileStorageEntry(roleName, profile)
 
 	if err != nil {
 		return logical.ErrorResponse("error creating config storage entry for profile"), err
@@ -60,11 +121,9 @@ func (b *backend) opReadConfigProfile(ctx context.Context, req *logical.Request,
 		return logical.ErrorResponse("invalid CAGW role configuration"), err
 	}
 
-	if len(profileId) <= 0 {
-		profileId = configCa.ProfileId
-		if len(profileId) <= 0 {
-			return logical.ErrorResponse("missing the profile ID"), nil
-		}
+	profileId, err = configCa.profileIdFor(profileId)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
 	storageEntry, err := req.Storage.Get(ctx, "config/"+roleName+"/profiles/"+profileId)
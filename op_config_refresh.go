@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+)
+
+func (b *backend) opWriteConfigRefresh(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	roleName := data.Get("roleName").(string)
+	profileId := getProfileId(data)
+
+	configRole, err := getConfigRole(ctx, req, roleName)
+	if err != nil {
+		return logical.ErrorResponse("invalid CAGW role configuration"), err
+	}
+
+	// Refresh the given profile or every profile configured for the role
+	var profileIds []string
+	if len(profileId) > 0 {
+		profileIds = []string{profileId}
+	} else {
+		profileIds, err = req.Storage.List(ctx, "config/"+roleName+"/profiles/")
+		if err != nil {
+			return logical.ErrorResponse("could not list profile configurations"), err
+		}
+		if len(profileIds) == 0 {
+			return logical.ErrorResponse("no profile configurations found for role " + roleName), nil
+		}
+	}
+
+	var drifts []map[string]interface{}
+	for _, id := range profileIds {
+		drift, err := b.refreshConfigProfile(ctx, req, roleName, configRole, id)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Error refreshing profile %s: %s", id, err)), nil
+		}
+		drifts = append(drifts, drift)
+	}
+
+	respData := map[string]interface{}{
+		"Message":  "Refresh successful",
+		"RoleName": roleName,
+		"Profiles": drifts,
+	}
+
+	return &logical.Response{
+		Data: respData,
+	}, nil
+}
+
+// refreshConfigProfile fetches the current definition of a configured profile
+// from CAGW, stores the updated profile configuration and returns the drift.
+func (b *backend) refreshConfigProfile(ctx context.Context, req *logical.Request, roleName string, configRole *CAGWConfigRole, profileId string) (map[string]interface{}, error) {
+	configProfile, err := getConfigProfile(ctx, req, roleName, profileId)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsClientConfig, err := getTLSConfig(ctx, req, configRole)
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving TLS configuration: %w", err)
+	}
+
+	profileResp, err := CAGWConfigProfileID{Id: profileId}.getProfile(ctx, tlsClientConfig, configRole, roleName)
+	if err != nil {
+		return nil, fmt.Errorf("Error response received from gateway: %w", err)
+	}
+
+	drift := configProfile.refresh(&profileResp.Profile)
+
+	storageEntry, err := configProfileStorageEntry(roleName, configProfile)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating config storage entry for profile")
+	}
+
+	err = req.Storage.Put(ctx, storageEntry)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not store configuration")
+	}
+
+	if drift["Drift"].(bool) {
+		b.Logger().Warn(fmt.Sprintf("Profile %s of role %s changed on CAGW: %v", profileId, roleName, drift))
+	}
+
+	return drift, nil
+}
+
+// periodicRefreshProfiles refreshes the profile configurations that have a
+// refresh interval and were last refreshed longer ago than that interval.
+// Only the active node of the primary cluster refreshes, since the refresh
+// writes to storage.
+func (b *backend) periodicRefreshProfiles(ctx context.Context, req *logical.Request) error {
+	if !b.writesStorage() {
+		return nil
+	}
+
+	roleNames, err := req.Storage.List(ctx, "config/")
+	if err != nil {
+		return err
+	}
+
+	for _, roleName := range roleNames {
+		if strings.HasSuffix(roleName, "/") {
+			continue
+		}
+
+		profileIds, err := req.Storage.List(ctx, "config/"+roleName+"/profiles/")
+		if err != nil {
+			return err
+		}
+
+		var configRole *CAGWConfigRole
+		for _, profileId := range profileIds {
+			configProfile, err := getConfigProfile(ctx, req, roleName, profileId)
+			if err != nil {
+				b.Logger().Error(err.Error())
+				continue
+			}
+			if configProfile.RefreshInterval <= 0 || time.Since(configProfile.LastRefreshed) < configProfile.RefreshInterval {
+				continue
+			}
+
+			if configRole == nil {
+				configRole, err = getConfigRole(ctx, req, roleName)
+				if err != nil {
+					b.Logger().Error(err.Error())
+					break
+				}
+			}
+
+			if _, err := b.refreshConfigProfile(ctx, req, roleName, configRole, profileId); err != nil {
+				b.Logger().Error(fmt.Sprintf("Error refreshing profile %s of role %s: %s", profileId, roleName, err))
+			}
+		}
+	}
+
+	return nil
+}
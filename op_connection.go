@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func (b *backend) opWriteConnection(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	name := data.Get("name").(string)
+	connection := connectionFromFieldData(data)
+
+	b.Logger().Info(fmt.Sprintf(`
+Configuring CAGW connection
+name: %s
+url:  %s
+`,
+		name, strings.Join(connection.endpoints(), ", ")))
+
+	if len(name) == 0 {
+		return logical.ErrorResponse("must provide name for connection"), nil
+	}
+	if err := connection.validate(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	storageEntry, err := connectionStorageEntry(name, connection)
+
+	if err != nil {
+		return logical.ErrorResponse("error creating connection storage entry: " + err.Error()), err
+	}
+
+	err = req.Storage.Put(ctx, storageEntry)
+	if err != nil {
+		return logical.ErrorResponse("could not store connection: " + err.Error()), err
+	}
+
+	respData := map[string]interface{}{
+		"Message":    "Configuration successful",
+		"Connection": name,
+		"URL":        connection.URL,
+		"URLs":       connection.URLs,
+	}
+
+	return &logical.Response{
+		Data: respData,
+	}, nil
+}
+
+func (b *backend) opReadConnection(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	name := data.Get("name").(string)
+
+	connection, err := getConnection(ctx, req.Storage, name)
+	if err != nil {
+		return logical.ErrorResponse("could not read connection: " + err.Error()), nil
+	}
+
+	// The client credentials are write-only, the connection is returned
+	// redacted like the connection settings of a role configuration
+	resp := &logical.Response{
+		Data: connectionResponseData(connection),
+	}
+
+	return resp, nil
+}
+
+func (b *backend) opListConnections(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	entries, err := req.Storage.List(ctx, "connections/")
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(entries), nil
+}
+
+func (b *backend) opDeleteConnection(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	name := data.Get("name").(string)
+
+	// Refuse to delete a connection that role configurations still use
+	roleNames, err := req.Storage.List(ctx, "config/")
+	if err != nil {
+		return logical.ErrorResponse("could not list role configurations: " + err.Error()), err
+	}
+
+	var inUse []string
+	for _, roleName := range roleNames {
+		if strings.HasSuffix(roleName, "/") {
+			continue
+		}
+		configRole, err := getStoredConfigRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return logical.ErrorResponse("could not read role configuration: " + err.Error()), err
+		}
+		if configRole.Connection == name {
+			inUse = append(inUse, roleName)
+		}
+	}
+
+	if len(inUse) > 0 {
+		return logical.ErrorResponse("connection is used by role configurations: " + strings.Join(inUse, ", ")), nil
+	}
+
+	err = req.Storage.Delete(ctx, "connections/"+name)
+	if err != nil {
+		return logical.ErrorResponse("could not delete connection: " + err.Error()), err
+	}
+
+	return nil, nil
+}
+
+// connectionResponseData returns the connection settings keyed by the field
+// names of the original storage layout. The client credentials are write-only:
+// only whether they are set and the fingerprint of the client certificate are
+// returned.
+func connectionResponseData(connection *CAGWConnection) map[string]interface{} {
+	return map[string]interface{}{
+		"PEMBundleSet":           len(connection.PEMBundle) > 0,
+		"PKCS12Set":              len(connection.PKCS12) > 0,
+		"PKCS12PasswordSet":      len(connection.PKCS12Password) > 0,
+		"KeyPasswordSet":         len(connection.KeyPassword) > 0,
+		"CertificateFingerprint": clientCertificateFingerprint(connection),
+		"URL":                    connection.URL,
+		"CACerts":                connection.CACerts,
+
+		"URLs":             connection.URLs,
+		"FailoverCooldown": int64(connection.FailoverCooldown.Seconds()),
+
+		"ConnectTimeout":      int64(connection.ConnectTimeout.Seconds()),
+		"TLSHandshakeTimeout": int64(connection.TLSHandshakeTimeout.Seconds()),
+		"RequestTimeout":      int64(connection.RequestTimeout.Seconds()),
+		"ProxyURL":            connection.ProxyURL,
+		"TLSMinVersion":       connection.TLSMinVersion,
+		"CipherSuites":        connection.CipherSuites,
+		"TLSServerName":       connection.TLSServerName,
+	}
+}
+
+// clientCertificateFingerprint returns the SHA-256 fingerprint of the client
+// certificate of the connection, or an empty string if the credentials cannot
+// be loaded.
+func clientCertificateFingerprint(connection *CAGWConnection) string {
+	certificate, err := getClientCertificate(connection)
+	if err != nil || len(certificate.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(certificate.Certificate[0])
+	return certutil.GetHexFormatted(sum[:], ":")
+}
@@ -0,0 +1,517 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+)
+
+const (
+	configExportVersion = 1
+
+	exportSecretsInclude = "include"
+	exportSecretsOmit    = "omit"
+	exportSecretsEncrypt = "encrypt"
+
+	importConflictFail      = "fail"
+	importConflictSkip      = "skip"
+	importConflictOverwrite = "overwrite"
+
+	encryptedSecretPrefix = "encrypted:"
+)
+
+// configExport is the document produced by the export endpoint and consumed
+// by the import endpoint. Profiles are keyed by role name and profile ID.
+type configExport struct {
+	Version      int                                     `json:"version"`
+	Secrets      string                                  `json:"secrets"`
+	EncryptedKey string                                  `json:"encrypted_key,omitempty"`
+	Connections  map[string]CAGWConnection               `json:"connections"`
+	Roles        map[string]CAGWConfigCAConfigProfileIDs `json:"roles"`
+	Profiles     map[string]map[string]CAGWConfigProfile `json:"profiles"`
+}
+
+func (b *backend) opExportConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	secrets := data.Get("secrets").(string)
+	publicKeyPem := data.Get("public_key").(string)
+
+	doc := configExport{
+		Version:     configExportVersion,
+		Secrets:     secrets,
+		Connections: map[string]CAGWConnection{},
+		Roles:       map[string]CAGWConfigCAConfigProfileIDs{},
+		Profiles:    map[string]map[string]CAGWConfigProfile{},
+	}
+
+	var transform func(string) (string, error)
+	switch secrets {
+	case exportSecretsInclude:
+	case exportSecretsOmit:
+		transform = func(string) (string, error) { return "", nil }
+	case exportSecretsEncrypt:
+		if len(publicKeyPem) == 0 {
+			return logical.ErrorResponse("a public_key is required to encrypt secrets"), nil
+		}
+		aead, encryptedKey, err := newExportCipher(publicKeyPem)
+		if err != nil {
+			return logical.ErrorResponse("could not set up secret encryption: " + err.Error()), nil
+		}
+		doc.EncryptedKey = encryptedKey
+		transform = func(value string) (string, error) { return encryptSecret(aead, value) }
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Invalid secrets mode specified: %s", secrets)), nil
+	}
+
+	connectionNames, err := req.Storage.List(ctx, "connections/")
+	if err != nil {
+		return logical.ErrorResponse("could not list connections"), err
+	}
+	for _, name := range connectionNames {
+		connection, err := getConnection(ctx, req.Storage, name)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), err
+		}
+		if err := connection.transformSecrets(transform); err != nil {
+			return logical.ErrorResponse("could not encrypt secrets: " + err.Error()), err
+		}
+		doc.Connections[name] = *connection
+	}
+
+	roleNames, err := req.Storage.List(ctx, "config/")
+	if err != nil {
+		return logical.ErrorResponse("could not list role configurations"), err
+	}
+	for _, roleName := range roleNames {
+		if strings.HasSuffix(roleName, "/") {
+			continue
+		}
+
+		role, err := getStoredConfigRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), err
+		}
+		if err := role.CAGWConnection.transformSecrets(transform); err != nil {
+			return logical.ErrorResponse("could not encrypt secrets: " + err.Error()), err
+		}
+		doc.Roles[roleName] = *role
+
+		profileIds, err := req.Storage.List(ctx, "config/"+roleName+"/profiles/")
+		if err != nil {
+			return logical.ErrorResponse("could not list profile configurations of " + roleName), err
+		}
+		for _, profileId := range profileIds {
+			profile, err := getConfigProfile(ctx, req, roleName, profileId)
+			if err != nil {
+				return logical.ErrorResponse(err.Error()), err
+			}
+			if doc.Profiles[roleName] == nil {
+				doc.Profiles[roleName] = map[string]CAGWConfigProfile{}
+			}
+			doc.Profiles[roleName][profileId] = *profile
+		}
+	}
+
+	document, err := json.Marshal(doc)
+	if err != nil {
+		return logical.ErrorResponse("could not encode export document"), err
+	}
+
+	respData := map[string]interface{}{
+		"Document":    string(document),
+		"Connections": len(doc.Connections),
+		"Roles":       len(doc.Roles),
+	}
+
+	return &logical.Response{
+		Data: respData,
+	}, nil
+}
+
+func (b *backend) opImportConfig(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+
+	document := data.Get("document").(string)
+	conflict := data.Get("conflict").(string)
+	dryRun := data.Get("dry_run").(bool)
+	privateKeyPem := data.Get("private_key").(string)
+
+	if conflict != importConflictFail && conflict != importConflictSkip && conflict != importConflictOverwrite {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid conflict mode specified: %s", conflict)), nil
+	}
+
+	doc, err := decodeConfigExport([]byte(document))
+	if err != nil {
+		return logical.ErrorResponse("import document could not be parsed: " + err.Error()), nil
+	}
+
+	var warnings []string
+	var transform func(string) (string, error)
+	switch doc.Secrets {
+	case exportSecretsInclude:
+	case exportSecretsEncrypt:
+		if len(privateKeyPem) == 0 {
+			return logical.ErrorResponse("the document contains encrypted secrets; a private_key is required"), nil
+		}
+		aead, err := openExportCipher(privateKeyPem, doc.EncryptedKey)
+		if err != nil {
+			return logical.ErrorResponse("could not decrypt the secrets: " + err.Error()), nil
+		}
+		transform = func(value string) (string, error) { return decryptSecret(aead, value) }
+	case exportSecretsOmit:
+		warnings = append(warnings, "the document does not contain credentials; existing connections and role "+
+			"configurations keep their credentials, new ones must be written again with their credentials before use")
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Invalid secrets mode in the document: %q", doc.Secrets)), nil
+	}
+
+	// Collect every entry to write first, so that nothing is written when a
+	// conflict makes the import fail.
+	type importEntry struct {
+		kind  string
+		name  string
+		key   string
+		value interface{}
+	}
+	var entries []importEntry
+
+	for _, name := range sortedKeys(doc.Connections) {
+		connection := doc.Connections[name]
+		if err := connection.transformSecrets(transform); err != nil {
+			return logical.ErrorResponse("could not decrypt secrets of connection " + name + ": " + err.Error()), nil
+		}
+		if doc.Secrets == exportSecretsOmit {
+			existing, err := req.Storage.Get(ctx, "connections/"+name)
+			if err != nil {
+				return logical.ErrorResponse("could not read connection " + name), err
+			}
+			if existing != nil {
+				stored, err := decodeConnection(existing.Value)
+				if err != nil {
+					return logical.ErrorResponse("could not parse connection " + name + ": " + err.Error()), nil
+				}
+				connection.keepSecrets(stored)
+			}
+		}
+		entries = append(entries, importEntry{"connection", name, "connections/" + name, connectionEntry{storageSchemaVersion, connection}})
+	}
+	for _, roleName := range sortedKeys(doc.Roles) {
+		role := doc.Roles[roleName]
+		if err := role.CAGWConnection.transformSecrets(transform); err != nil {
+			return logical.ErrorResponse("could not decrypt secrets of role configuration " + roleName + ": " + err.Error()), nil
+		}
+		if doc.Secrets == exportSecretsOmit {
+			existing, err := req.Storage.Get(ctx, "config/"+roleName)
+			if err != nil {
+				return logical.ErrorResponse("could not read role configuration " + roleName), err
+			}
+			if existing != nil {
+				stored, err := decodeConfigRole(existing.Value)
+				if err != nil {
+					return logical.ErrorResponse("could not parse role configuration " + roleName + ": " + err.Error()), nil
+				}
+				role.CAGWConnection.keepSecrets(&stored.CAGWConnection)
+			}
+		}
+		if len(role.Connection) > 0 {
+			if _, ok := doc.Connections[role.Connection]; !ok {
+				if _, err := getConnection(ctx, req.Storage, role.Connection); err != nil {
+					return logical.ErrorResponse(fmt.Sprintf("role configuration %s refers to unknown connection %s", roleName, role.Connection)), nil
+				}
+			}
+		}
+		role.SchemaVersion = storageSchemaVersion
+		entries = append(entries, importEntry{"role", roleName, "config/" + roleName, role})
+	}
+	for _, roleName := range sortedKeys(doc.Profiles) {
+		if _, ok := doc.Roles[roleName]; !ok {
+			return logical.ErrorResponse(fmt.Sprintf("profile configurations refer to unknown role configuration %s", roleName)), nil
+		}
+		profiles := doc.Profiles[roleName]
+		for _, profileId := range sortedKeys(profiles) {
+			profile := profiles[profileId]
+			profile.SchemaVersion = storageSchemaVersion
+			entries = append(entries, importEntry{"profile", roleName + "/" + profileId, "config/" + roleName + "/profiles/" + profileId, profile})
+		}
+	}
+
+	var actions []map[string]interface{}
+	var conflicts []string
+	for _, e := range entries {
+		existing, err := req.Storage.Get(ctx, e.key)
+		if err != nil {
+			return logical.ErrorResponse("could not read " + e.key), err
+		}
+
+		action := "create"
+		if existing != nil {
+			switch conflict {
+			case importConflictFail:
+				conflicts = append(conflicts, e.kind+" "+e.name)
+				action = "conflict"
+			case importConflictSkip:
+				action = "skip"
+			case importConflictOverwrite:
+				action = "overwrite"
+			}
+		}
+
+		actions = append(actions, map[string]interface{}{
+			"Type":   e.kind,
+			"Name":   e.name,
+			"Action": action,
+		})
+	}
+
+	if len(conflicts) > 0 {
+		resp := logical.ErrorResponse("import conflicts with existing configuration: " + strings.Join(conflicts, ", "))
+		resp.Data["Actions"] = actions
+		return resp, nil
+	}
+
+	if !dryRun {
+		for i, e := range entries {
+			if actions[i]["Action"] == "skip" {
+				continue
+			}
+			storageEntry, err := logical.StorageEntryJSON(e.key, e.value)
+			if err != nil {
+				return logical.ErrorResponse("error creating storage entry for " + e.kind + " " + e.name), err
+			}
+			if err := req.Storage.Put(ctx, storageEntry); err != nil {
+				return logical.ErrorResponse("could not store " + e.kind + " " + e.name), err
+			}
+		}
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"DryRun":  dryRun,
+			"Actions": actions,
+		},
+	}
+	for _, w := range warnings {
+		resp.AddWarning(w)
+	}
+
+	return resp, nil
+}
+
+// decodeConfigExport parses an export document. The entries in the document
+// are decoded like storage entries, so documents exported before the current
+// storage layout can still be imported.
+func decodeConfigExport(document []byte) (*configExport, error) {
+	var raw struct {
+		Version      int                                   `json:"version"`
+		Secrets      string                                `json:"secrets"`
+		EncryptedKey string                                `json:"encrypted_key"`
+		Connections  map[string]json.RawMessage            `json:"connections"`
+		Roles        map[string]json.RawMessage            `json:"roles"`
+		Profiles     map[string]map[string]json.RawMessage `json:"profiles"`
+	}
+	if err := json.Unmarshal(document, &raw); err != nil {
+		return nil, err
+	}
+	if raw.Version != configExportVersion {
+		return nil, errors.Errorf("unsupported document version: %d", raw.Version)
+	}
+
+	doc := &configExport{
+		Version:      raw.Version,
+		Secrets:      raw.Secrets,
+		EncryptedKey: raw.EncryptedKey,
+		Connections:  map[string]CAGWConnection{},
+		Roles:        map[string]CAGWConfigCAConfigProfileIDs{},
+		Profiles:     map[string]map[string]CAGWConfigProfile{},
+	}
+	for name, value := range raw.Connections {
+		connection, err := decodeConnection(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "connection %s", name)
+		}
+		doc.Connections[name] = *connection
+	}
+	for roleName, value := range raw.Roles {
+		role, err := decodeConfigRole(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "role configuration %s", roleName)
+		}
+		doc.Roles[roleName] = *role
+	}
+	for roleName, profiles := range raw.Profiles {
+		doc.Profiles[roleName] = map[string]CAGWConfigProfile{}
+		for profileId, value := range profiles {
+			profile, err := decodeConfigProfile(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "profile configuration %s/%s", roleName, profileId)
+			}
+			doc.Profiles[roleName][profileId] = *profile
+		}
+	}
+
+	return doc, nil
+}
+
+// transformSecrets replaces the credentials of a connection with the output
+// of the given function. A nil function leaves the credentials untouched.
+func (c *CAGWConnection) transformSecrets(transform func(string) (string, error)) error {
+	if transform == nil {
+		return nil
+	}
+	for _, secret := range []*string{&c.PEMBundle, &c.PKCS12, &c.PKCS12Password, &c.KeyPassword} {
+		value, err := transform(*secret)
+		if err != nil {
+			return err
+		}
+		*secret = value
+	}
+	return nil
+}
+
+// keepSecrets copies the credentials of the stored connection into an
+// imported connection without credentials, so that importing a document
+// exported without them does not remove the credentials in use.
+func (c *CAGWConnection) keepSecrets(stored *CAGWConnection) {
+	if len(c.PEMBundle) > 0 || len(c.PKCS12) > 0 || len(c.PKCS12Password) > 0 || len(c.KeyPassword) > 0 {
+		return
+	}
+	c.PEMBundle = stored.PEMBundle
+	c.PKCS12 = stored.PKCS12
+	c.PKCS12Password = stored.PKCS12Password
+	c.KeyPassword = stored.KeyPassword
+}
+
+// newExportCipher creates a random AES-256-GCM key for the secrets of an
+// export and returns it along with the key encrypted with RSA-OAEP for the
+// given public key.
+func newExportCipher(publicKeyPem string) (cipher.AEAD, string, error) {
+	block, _ := pem.Decode([]byte(publicKeyPem))
+	if block == nil {
+		return nil, "", errors.New("public key could not be decoded")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "public key could not be parsed")
+	}
+	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, "", errors.New("public key must be an RSA key")
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, "", err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPublicKey, key, nil)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "key could not be encrypted")
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return aead, base64.StdEncoding.EncodeToString(encryptedKey), nil
+}
+
+// openExportCipher decrypts the key of an export with the given private key.
+func openExportCipher(privateKeyPem string, encryptedKey string) (cipher.AEAD, error) {
+	block, _ := pem.Decode([]byte(privateKeyPem))
+	if block == nil {
+		return nil, errors.New("private key could not be decoded")
+	}
+	var privateKey interface{}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "private key could not be parsed")
+		}
+	}
+	rsaPrivateKey, ok := privateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key must be an RSA key")
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encryptedKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "encrypted key could not be base64 decoded")
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaPrivateKey, ciphertext, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "encrypted key could not be decrypted")
+	}
+
+	return newAEAD(key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptSecret(aead cipher.AEAD, value string) (string, error) {
+	if len(value) == 0 {
+		return "", nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), nil)
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(aead cipher.AEAD, value string) (string, error) {
+	if len(value) == 0 {
+		return "", nil
+	}
+	if !strings.HasPrefix(value, encryptedSecretPrefix) {
+		return "", errors.New("secret is not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedSecretPrefix))
+	if err != nil {
+		return "", errors.Wrap(err, "secret could not be base64 decoded")
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("secret is too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.Wrap(err, "secret could not be decrypted")
+	}
+	return string(plaintext), nil
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
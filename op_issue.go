@@ -6,22 +6,21 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto"
 	"crypto/rand"
 	"math/big"
 
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
-	"encoding/json"
 	"encoding/pem"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"strings"
 
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"software.sslmate.com/src/go-pkcs12"
@@ -30,27 +29,49 @@ import (
 func (b *backend) opWriteIssue(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	roleName := data.Get("roleName").(string)
 	subjectVariables := data.Get("subject_variables").(string)
-	format := data.Get("format").(string)
+	format, err := getFormat(data, "pem", "pem_bundle", "der", "pkcs12")
+	if err != nil {
+		return logical.ErrorResponse("%v", err), nil
+	}
 
-	if strings.EqualFold(format, "pem") != true {
-		return logical.ErrorResponse("Unsupported format: %s", format), nil
+	pkcs12Password := data.Get("pkcs12_password").(string)
+	if *format == "pkcs12" && len(pkcs12Password) == 0 {
+		return logical.ErrorResponse("pkcs12_password is required for the pkcs12 format"), nil
 	}
 
-	if len(subjectVariables) <= 0 {
-		return logical.ErrorResponse("subject_variables is empty"), nil
+	// The private key follows the certificate format unless asked otherwise
+	privateKeyFormat := data.Get("private_key_format").(string)
+	privateKeyPassphrase := data.Get("private_key_passphrase").(string)
+	if len(privateKeyFormat) > 0 {
+		if !strutil.StrListContains(privateKeyFormats, privateKeyFormat) {
+			return logical.ErrorResponse("Invalid private key format specified: %s", privateKeyFormat), nil
+		}
+		if *format == "pkcs12" {
+			return logical.ErrorResponse("private_key_format cannot be combined with the pkcs12 format"), nil
+		}
+		if *format == "pem_bundle" && privateKeyFormat == "der" {
+			return logical.ErrorResponse("the der private key format cannot be combined with the pem_bundle format"), nil
+		}
+	} else if *format == "der" {
+		privateKeyFormat = "der"
+	} else {
+		privateKeyFormat = "pem"
+	}
+	if privateKeyFormat == "encrypted_pkcs8" && len(privateKeyPassphrase) == 0 {
+		return logical.ErrorResponse("private_key_passphrase is required for the encrypted_pkcs8 private key format"), nil
 	}
 
-	subjectVars, err := processSubjectVariables(subjectVariables)
-	if err != nil {
-		return logical.ErrorResponse("Failed parsing the subject_variables"), err
+	keyType := data.Get("key_type").(string)
+	keyBits := data.Get("key_bits").(int)
+	if len(keyType) == 0 && keyBits != 0 {
+		return logical.ErrorResponse("key_bits requires key_type"), nil
 	}
 
-	altNames := data.Get("alt_names").([]string)
-	var subjAltNames []SubjectAltName
-	if len(altNames) > 0 {
-		subjAltNames, err = processSubjectAltNames(altNames)
+	var subjectVars []SubjectVariable
+	if len(subjectVariables) > 0 {
+		subjectVars, err = processSubjectVariables(subjectVariables)
 		if err != nil {
-			return logical.ErrorResponse("Failed parsing the subject alt names: %s", altNames), err
+			return logical.ErrorResponse("Failed parsing the subject_variables"), err
 		}
 	}
 
@@ -59,12 +80,14 @@ func (b *backend) opWriteIssue(ctx context.Context, req *logical.Request, data *
 		return logical.ErrorResponse("Error fetching config"), err
 	}
 
-	profileId := configRole.ProfileId
-	if len(profileId) <= 0 {
-		profileId = data.Get("profile").(string)
-		if len(profileId) <= 0 {
-			return logical.ErrorResponse("a profile must be specified for this CA role configuration"), nil
-		}
+	profileId, err := configRole.profileIdFor(data.Get("profile").(string))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	responseMode, err := getResponseMode(data, configRole)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
 	configProfile, err := getConfigProfile(ctx, req, roleName, profileId)
@@ -72,95 +95,146 @@ func (b *backend) opWriteIssue(ctx context.Context, req *logical.Request, data *
 		return logical.ErrorResponse("Could not get profile configuration for profile " + profileId + ": " + err.Error()), err
 	}
 
-	ttl := getTTL(data, configProfile)
+	altNames := data.Get("alt_names").([]string)
+	var subjAltNames []SubjectAltName
+	if len(altNames) > 0 {
+		subjAltNames, err = processSubjectAltNames(altNames, configProfile)
+		if err != nil {
+			return logical.ErrorResponse("Failed parsing the subject alt names: %s", altNames), err
+		}
+	}
 
-	password, err := GenerateRandomString(32)
+	subjectVars, subjAltNames, err = processPKIFields(data, configProfile, subjectVars, subjAltNames)
 	if err != nil {
-		return logical.ErrorResponse("Error generating random password: " + err.Error()), err
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
-	// Construct enrollment request
-	enrollmentRequest := EnrollmentRequest{
-		ProfileId: profileId,
-		RequiredFormat: RequiredFormat{
-			Format: "PKCS12",
-			Protection: &Protection{
-				Type:     "PasswordProtection",
-				Password: password,
-			},
-		},
-		SubjectVariables: subjectVars,
-		SubjectAltNames:  subjAltNames,
-		OptionalCertificateRequestDetails: CertificateRequestDetails{
-			ValidityPeriod: fmt.Sprintf("PT%dM", int64(ttl.Minutes())),
-		},
+	entity, err := b.requestEntity(req)
+	if err != nil {
+		return logical.ErrorResponse("Error fetching the identity entity of the caller"), err
 	}
 
-	body, err := json.Marshal(enrollmentRequest)
+	subjectVars, subjAltNames, violations, err := configProfile.applyFixedValues(subjectVars, subjAltNames, entity)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	subjectVars, subjAltNames, err = configProfile.applyDefaultValues(subjectVars, subjAltNames, entity)
 	if err != nil {
-		return logical.ErrorResponse("Error constructing enrollment request: %v", err), err
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
-	if b.Logger().IsDebug() {
-		b.Logger().Debug(fmt.Sprintf("Enrollment request body: %v", string(body)))
+	if len(subjectVars) <= 0 {
+		return logical.ErrorResponse("subject_variables is empty"), nil
 	}
 
-	tlsClientConfig, err := getTLSConfig(ctx, req, configRole)
+	violations = append(violations, configProfile.checkRequirements(subjectVars, subjAltNames, nil)...)
+	violations = append(violations, configProfile.checkNamePolicy(subjectVars, subjAltNames)...)
+	enrollmentOptions, optionViolations := configProfile.enrollmentOptions(data.Get("enrollment_options").(map[string]string))
+	violations = append(violations, optionViolations...)
+	requestDetails, enrollmentOptions, err := requestDetailsFromOptions(enrollmentOptions)
 	if err != nil {
-		return logical.ErrorResponse("Error retrieving TLS configuration: %v", err), err
+		violations = append(violations, err.Error())
+	}
+	if len(violations) > 0 {
+		return requirementsErrorResponse(violations), nil
 	}
 
-	tr := &http.Transport{
-		Proxy:           http.ProxyFromEnvironment,
-		TLSClientConfig: tlsClientConfig,
+	if denials := configProfile.checkEntityBinding(configProfile.domainNames(subjectVars, subjAltNames), entity); len(denials) > 0 {
+		return entityBindingErrorResponse(denials), logical.ErrPermissionDenied
 	}
 
-	client := &http.Client{Transport: tr}
+	var warnings []string
+	requestDetails.ValidityPeriod, warnings, err = b.getValidityPeriod(data, configProfile)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
 
 	caId := configRole.CAId
 	if len(caId) == 0 {
 		caId = roleName
 	}
 
-	resp, err := client.Post(configRole.URL+"/v1/certificate-authorities/"+caId+"/enrollments", "application/json", bytes.NewReader(body))
-	if err != nil {
-		return logical.ErrorResponse("Error response: %v", err), err
+	// Construct enrollment request
+	enrollmentRequest := EnrollmentRequest{
+		ProfileId:                         profileId,
+		SubjectVariables:                  subjectVars,
+		SubjectAltNames:                   subjAltNames,
+		OptionalCertificateRequestDetails: requestDetails,
+		Options:                           enrollmentOptions,
 	}
 
-	responseBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return logical.ErrorResponse("CAGW response could not be read: %v", err), err
-	}
+	var privateKey crypto.PrivateKey
+	var certificate *x509.Certificate
+	var caCerts []*x509.Certificate
+	var endpoint string
 
-	if b.Logger().IsTrace() {
-		b.Logger().Trace("response body: " + string(responseBody))
-	}
+	if len(keyType) > 0 {
+		// The key is generated here and only the CSR is sent to the gateway
+		if !configProfile.keyTypeAllowed(keyType) {
+			return logical.ErrorResponse("Key type %s is not allowed for profile %s", keyType, profileId), nil
+		}
 
-	err = CheckForError(b, responseBody, resp.StatusCode)
-	if err != nil {
-		return logical.ErrorResponse("Error response received from gateway: %v", err), err
-	}
+		signer, err := generatePrivateKey(keyType, keyBits)
+		if err != nil {
+			return logical.ErrorResponse("Error generating private key: %v", err), nil
+		}
+		if err := configProfile.checkPublicKey(signer.Public()); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
 
-	var enrollmentResponse EnrollmentResponse
-	err = json.Unmarshal(responseBody, &enrollmentResponse)
-	if err != nil {
-		return logical.ErrorResponse("CAGW enrollment response could not be parsed: %v", err), err
-	}
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, signer)
+		if err != nil {
+			return logical.ErrorResponse("Error creating CSR: %v", err), err
+		}
 
-	b.Logger().Debug(string(enrollmentResponse.Enrollment.Body))
-	base64P12 := enrollmentResponse.Enrollment.Body
-	p12, err := base64.StdEncoding.DecodeString(base64P12)
-	if err != nil {
-		return logical.ErrorResponse("base64 could not be decoded: %v", err), err
+		enrollment, err := b.enrollCSR(ctx, req, configRole, caId, csr, enrollmentRequest)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), err
+		}
+
+		privateKey, certificate, caCerts, endpoint = signer, enrollment.Certificate, enrollment.Chain, enrollment.Endpoint
+	} else {
+		password, err := GenerateRandomString(32)
+		if err != nil {
+			return logical.ErrorResponse("Error generating random password: " + err.Error()), err
+		}
+
+		enrollmentRequest.RequiredFormat = RequiredFormat{
+			Format: "PKCS12",
+			Protection: &Protection{
+				Type:     "PasswordProtection",
+				Password: password,
+			},
+		}
+
+		enrollmentResponse, enrollmentEndpoint, err := b.enroll(ctx, req, configRole, caId, &enrollmentRequest)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), err
+		}
+
+		base64P12 := enrollmentResponse.Enrollment.Body
+		p12, err := base64.StdEncoding.DecodeString(base64P12)
+		if err != nil {
+			return logical.ErrorResponse("base64 could not be decoded: %v", err), err
+		}
+
+		privateKey, certificate, caCerts, err = pkcs12.DecodeChain(p12, password)
+		if err != nil {
+			return logical.ErrorResponse("error parsing the PKCS12: %v", err), err
+		}
+		endpoint = enrollmentEndpoint
 	}
 
-	respData, err := Pkcs12ToPem(p12, password)
+	if len(caCerts) == 0 {
+		warnings = append(warnings, missingChainWarning)
+	}
 
+	respData, err := keyPairToPem(privateKey, certificate, caCerts)
 	if err != nil {
-		return logical.ErrorResponse("error parsing the PKCS12: %v", err), err
+		return logical.ErrorResponse("error encoding the certificate and key: %v", err), err
 	}
 
-	storageEntry, err := logical.StorageEntryJSON("issue/"+roleName+"/"+respData["serial_number"].(*big.Int).String(), respData)
+	storageEntry, err := certificateStorageEntry("issue", roleName, certificate, caCerts, responseMode, respData)
 
 	if err != nil {
 		return logical.ErrorResponse("error creating certificate storage entry"), err
@@ -171,8 +245,46 @@ func (b *backend) opWriteIssue(ctx context.Context, req *logical.Request, data *
 		return logical.ErrorResponse("could not store certificate"), err
 	}
 
+	// The certificate is stored in PEM whatever the returned format is
+	if *format != "pkcs12" {
+		respData["private_key"], err = encodePrivateKey(respData["private_key"].(string), privateKeyFormat, privateKeyPassphrase)
+		if err != nil {
+			return logical.ErrorResponse("error encoding the private key: %v", err), err
+		}
+	}
+
+	switch *format {
+	case "der":
+		respData, err = pemToDer(respData)
+		if err != nil {
+			return logical.ErrorResponse("error encoding the certificate as DER: %v", err), err
+		}
+
+	case "pem_bundle":
+		respData["certificate"] = pemBundle(respData)
+
+	case "pkcs12":
+		p12Base64, err := encodePkcs12(privateKey, certificate, caCerts, pkcs12Password)
+		if err != nil {
+			return logical.ErrorResponse("error encoding the PKCS12: %v", err), err
+		}
+		respData = map[string]interface{}{
+			"pkcs12":           p12Base64,
+			"serial_number":    respData["serial_number"],
+			"private_key_type": respData["private_key_type"],
+			"key_algorithm":    respData["key_algorithm"],
+		}
+	}
+
+	if responseMode == responseModePKI {
+		addPKIResponseFields(respData, certificate, caCerts, *format)
+	}
+
+	respData["gateway_endpoint"] = endpoint
+
 	return &logical.Response{
-		Data: respData,
+		Data:     respData,
+		Warnings: warnings,
 	}, nil
 
 }
@@ -185,12 +297,10 @@ func (b *backend) opListIssue(ctx context.Context, req *logical.Request, data *f
 	return opListCerts(ctx, req, data, "issue")
 }
 
-func Pkcs12ToPem(p12 []byte, password string) (map[string]interface{}, error) {
-	privateKey, certificate, caCerts, err := pkcs12.DecodeChain([]byte(p12), password)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding PKCS12: %s", err)
-	}
-
+// keyPairToPem returns the PEM encoded private key, certificate and chain of an
+// issued certificate, whether the key was generated by the gateway or locally.
+func keyPairToPem(privateKey crypto.PrivateKey, certificate *x509.Certificate, caCerts []*x509.Certificate) (map[string]interface{}, error) {
+	var err error
 	respData := map[string]interface{}{}
 
 	var keyPemBlock *pem.Block
@@ -210,11 +320,26 @@ func Pkcs12ToPem(p12 []byte, password string) (map[string]interface{}, error) {
 			Type:  "EC PRIVATE KEY",
 			Bytes: keyBytes,
 		}
+	case ed25519.PrivateKey:
+		// Ed25519 keys have no traditional encoding, only PKCS#8
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding Ed25519 key to PEM: %s", err)
+		}
+		keyPemBlock = &pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: keyBytes,
+		}
 	default:
 		return nil, fmt.Errorf("unsupported private key type")
 	}
 	respData["private_key"] = string(pem.EncodeToMemory(keyPemBlock))
 
+	respData["private_key_type"], err = privateKeyType(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
 	var certPemBlock *pem.Block = &pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: certificate.Raw,
@@ -222,6 +347,7 @@ func Pkcs12ToPem(p12 []byte, password string) (map[string]interface{}, error) {
 	respData["certificate"] = string(pem.EncodeToMemory(certPemBlock))
 
 	respData["serial_number"] = certificate.SerialNumber
+	respData["key_algorithm"] = keyAlgorithm(certificate.PublicKey)
 
 	var caCertsBlocks string
 	for _, c := range caCerts {
@@ -236,6 +362,61 @@ func Pkcs12ToPem(p12 []byte, password string) (map[string]interface{}, error) {
 	return respData, nil
 }
 
+// pemToDer converts the PEM encoded certificate and chain of an issue response
+// to base64 encoded DER. The chain holds one certificate per line. The private
+// key is encoded separately according to the private key format.
+func pemToDer(pemData map[string]interface{}) (map[string]interface{}, error) {
+	respData := map[string]interface{}{
+		"serial_number":    pemData["serial_number"],
+		"private_key":      pemData["private_key"],
+		"private_key_type": pemData["private_key_type"],
+		"key_algorithm":    pemData["key_algorithm"],
+	}
+
+	block, _ := pem.Decode([]byte(pemData["certificate"].(string)))
+	if block == nil {
+		return nil, fmt.Errorf("certificate could not be decoded")
+	}
+	respData["certificate"] = base64.StdEncoding.EncodeToString(block.Bytes)
+
+	var chain []string
+	rest := []byte(pemData["chain"].(string))
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		chain = append(chain, base64.StdEncoding.EncodeToString(block.Bytes))
+	}
+	respData["chain"] = strings.Join(chain, "\n")
+
+	return respData, nil
+}
+
+// pemBundle concatenates the private key, certificate and chain of an issue
+// response.
+func pemBundle(pemData map[string]interface{}) string {
+	bundle := pemData["private_key"].(string) + pemData["certificate"].(string)
+	for _, c := range strings.Split(pemData["chain"].(string), "\n") {
+		if len(c) > 0 {
+			bundle = bundle + c + "\n"
+		}
+	}
+	return bundle
+}
+
+// encodePkcs12 returns the key, certificate and chain as a base64 encoded
+// PKCS#12 protected with the caller's password.
+func encodePkcs12(privateKey crypto.PrivateKey, certificate *x509.Certificate, caCerts []*x509.Certificate, password string) (string, error) {
+	p12, err := pkcs12.Encode(rand.Reader, privateKey, certificate, caCerts, password)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(p12), nil
+}
+
 func GenerateRandomString(n int) (string, error) {
 	const letters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-"
 	ret := make([]byte, n)
@@ -6,16 +6,10 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/x509"
 	"encoding/base64"
-	"encoding/json"
 	"encoding/pem"
-	"fmt"
-	"io/ioutil"
-	"math/big"
-	"net/http"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
@@ -30,7 +24,7 @@ func (b *backend) opWriteSign(ctx context.Context, req *logical.Request, data *f
 
 	var err error
 
-	format, err := getFormat(data)
+	format, err := getFormat(data, "pem", "pem_bundle", "der")
 	if err != nil {
 		return logical.ErrorResponse("%v", err), err
 	}
@@ -45,15 +39,6 @@ func (b *backend) opWriteSign(ctx context.Context, req *logical.Request, data *f
 		}
 	}
 
-	altNames := data.Get("alt_names").([]string)
-	var subjAltNames []SubjectAltName
-	if len(altNames) > 0 {
-		subjAltNames, err = processSubjectAltNames(altNames)
-		if err != nil {
-			return logical.ErrorResponse("Failed parsing the subject alt names: %s", altNames), err
-		}
-	}
-
 	csrPem := data.Get("csr").(string)
 	// Just decode a single block, omit any subsequent blocks
 	csrBlock, _ := pem.Decode([]byte(csrPem))
@@ -61,7 +46,16 @@ func (b *backend) opWriteSign(ctx context.Context, req *logical.Request, data *f
 		return logical.ErrorResponse("CSR could not be decoded"), nil
 	}
 
-	csrBase64 := base64.StdEncoding.EncodeToString(csrBlock.Bytes)
+	csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
+	if err != nil {
+		return logical.ErrorResponse("CSR could not be parsed: %v", err), nil
+	}
+	if csr.PublicKeyAlgorithm == x509.UnknownPublicKeyAlgorithm {
+		return logical.ErrorResponse("CSR has an unsupported key algorithm"), nil
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return logical.ErrorResponse("CSR signature is invalid: %v", err), nil
+	}
 
 	configRole, err := getConfigRole(ctx, req, roleName)
 	if err != nil {
@@ -73,12 +67,14 @@ func (b *backend) opWriteSign(ctx context.Context, req *logical.Request, data *f
 		caId = roleName
 	}
 
-	profileId := configRole.ProfileId
-	if len(profileId) <= 0 {
-		profileId = data.Get("profile").(string)
-		if len(profileId) <= 0 {
-			return logical.ErrorResponse("a profile must be specified for this CA role configuration"), nil
-		}
+	profileId, err := configRole.profileIdFor(data.Get("profile").(string))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	responseMode, err := getResponseMode(data, configRole)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
 	configProfile, err := getConfigProfile(ctx, req, roleName, profileId)
@@ -86,86 +82,108 @@ func (b *backend) opWriteSign(ctx context.Context, req *logical.Request, data *f
 		return logical.ErrorResponse("Could not get profile configuration for profile " + profileId + ": " + err.Error()), err
 	}
 
-	ttl := getTTL(data, configProfile)
-
-	// Construct enrollment request
-	enrollmentRequest := EnrollmentRequest{
-		ProfileId: profileId,
-		RequiredFormat: RequiredFormat{
-			Format:     "X509",
-			Protection: nil,
-		},
-		CSR:              csrBase64,
-		SubjectVariables: subjectVars,
-		SubjectAltNames:  subjAltNames,
-		OptionalCertificateRequestDetails: CertificateRequestDetails{
-			ValidityPeriod: fmt.Sprintf("PT%dM", int64(ttl.Minutes())),
-		},
-	}
-
-	body, err := json.Marshal(enrollmentRequest)
-	if err != nil {
-		return logical.ErrorResponse("Error constructing enrollment request: %v", err), err
+	// Enforce the key policy of the profile before anything is sent to CAGW
+	if err := configProfile.checkPublicKey(csr.PublicKey); err != nil {
+		return logical.ErrorResponse("CSR rejected: %v", err), nil
+	}
+	if err := configProfile.checkSignatureAlgorithm(csr.SignatureAlgorithm); err != nil {
+		return logical.ErrorResponse("CSR rejected: %v", err), nil
 	}
 
-	if b.Logger().IsDebug() {
-		b.Logger().Debug(fmt.Sprintf("Enrollment request body: %v", string(body)))
+	altNames := data.Get("alt_names").([]string)
+	var subjAltNames []SubjectAltName
+	if len(altNames) > 0 {
+		subjAltNames, err = processSubjectAltNames(altNames, configProfile)
+		if err != nil {
+			return logical.ErrorResponse("Failed parsing the subject alt names: %s", altNames), err
+		}
 	}
 
-	tlsClientConfig, err := getTLSConfig(ctx, req, configRole)
+	subjectVars, subjAltNames, err = processPKIFields(data, configProfile, subjectVars, subjAltNames)
 	if err != nil {
-		return logical.ErrorResponse("Error retrieving TLS configuration: %v", err), err
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
-	tr := &http.Transport{
-		Proxy:           http.ProxyFromEnvironment,
-		TLSClientConfig: tlsClientConfig,
+	entity, err := b.requestEntity(req)
+	if err != nil {
+		return logical.ErrorResponse("Error fetching the identity entity of the caller"), err
 	}
 
-	client := &http.Client{Transport: tr}
-	resp, err := client.Post(configRole.URL+"/v1/certificate-authorities/"+caId+"/enrollments", "application/json", bytes.NewReader(body))
+	// Fixed values take precedence over the CSR, defaults only fill what
+	// neither the request nor the CSR provides
+	subjectVars, subjAltNames, violations, err := configProfile.applyFixedValues(subjectVars, subjAltNames, entity)
 	if err != nil {
-		return logical.ErrorResponse("Error response: %v", err), err
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	useCSRValues := configProfile.UseCSRValues
+	if v, ok := data.GetOk("use_csr_values"); ok {
+		useCSRValues = v.(bool)
+	}
+	var unmapped []string
+	if useCSRValues {
+		subjectVars, subjAltNames, unmapped = processCSRValues(csr, configProfile, subjectVars, subjAltNames)
 	}
 
-	responseBody, err := ioutil.ReadAll(resp.Body)
+	subjectVars, subjAltNames, err = configProfile.applyDefaultValues(subjectVars, subjAltNames, entity)
 	if err != nil {
-		return logical.ErrorResponse("CAGW response could not be read: %v", err), err
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	// Required values may come from the CSR. The names in the CSR are checked
+	// too, in case the gateway takes them from the CSR rather than from the
+	// request
+	violations = append(violations, configProfile.checkRequirements(subjectVars, subjAltNames, csr)...)
+	allVars, allAltNames := configProfile.withCSRNames(subjectVars, subjAltNames, csr)
+	violations = append(violations, configProfile.checkNamePolicy(allVars, allAltNames)...)
+	enrollmentOptions, optionViolations := configProfile.enrollmentOptions(data.Get("enrollment_options").(map[string]string))
+	violations = append(violations, optionViolations...)
+	requestDetails, enrollmentOptions, err := requestDetailsFromOptions(enrollmentOptions)
+	if err != nil {
+		violations = append(violations, err.Error())
+	}
+	if len(violations) > 0 {
+		return requirementsErrorResponse(violations), nil
 	}
 
-	if b.Logger().IsTrace() {
-		b.Logger().Trace("response body: " + string(responseBody))
+	if denials := configProfile.checkEntityBinding(configProfile.domainNames(allVars, allAltNames), entity); len(denials) > 0 {
+		return entityBindingErrorResponse(denials), logical.ErrPermissionDenied
 	}
 
-	err = CheckForError(b, responseBody, resp.StatusCode)
+	var warnings []string
+	requestDetails.ValidityPeriod, warnings, err = b.getValidityPeriod(data, configProfile)
 	if err != nil {
-		return logical.ErrorResponse("Error response received from gateway: %v", err), err
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	// Construct enrollment request
+	enrollmentRequest := EnrollmentRequest{
+		ProfileId:                         profileId,
+		SubjectVariables:                  subjectVars,
+		SubjectAltNames:                   subjAltNames,
+		OptionalCertificateRequestDetails: requestDetails,
+		Options:                           enrollmentOptions,
 	}
 
-	var enrollmentResponse EnrollmentResponse
-	err = json.Unmarshal(responseBody, &enrollmentResponse)
+	enrollment, err := b.enrollCSR(ctx, req, configRole, caId, csrBlock.Bytes, enrollmentRequest)
 	if err != nil {
-		return logical.ErrorResponse("CAGW enrollment response could not be parsed: %v", err), err
+		return logical.ErrorResponse(err.Error()), err
+	}
+	certificate := enrollment.Certificate
+	if len(enrollment.Chain) == 0 {
+		warnings = append(warnings, missingChainWarning)
 	}
 
 	var respData map[string]interface{}
 	switch *format {
 	case "der":
 		respData = map[string]interface{}{
-			"certificate": enrollmentResponse.Enrollment.Body,
+			"certificate":   base64.StdEncoding.EncodeToString(certificate.Raw),
+			"serial_number": certificate.SerialNumber,
 		}
 
 	case "pem", "pem_bundle":
-		data, err := base64.StdEncoding.DecodeString(enrollmentResponse.Enrollment.Body)
-		if err != nil {
-			return logical.ErrorResponse("Error decoding base64 response from CAGW: %v", err), err
-		}
-		block := pem.Block{Type: "CERTIFICATE", Bytes: data}
-
-		certificate, err := x509.ParseCertificate(data)
-		if err != nil {
-			return logical.ErrorResponse("Failed to parse the certificate: %v", err), err
-		}
+		block := pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}
 
 		respData = map[string]interface{}{
 			"certificate":   string(pem.EncodeToMemory(&block)),
@@ -173,7 +191,10 @@ func (b *backend) opWriteSign(ctx context.Context, req *logical.Request, data *f
 		}
 	}
 
-	storageEntry, err := logical.StorageEntryJSON("sign/"+roleName+"/"+respData["serial_number"].(*big.Int).String(), respData)
+	respData["key_algorithm"] = keyAlgorithm(certificate.PublicKey)
+	respData["csr_key_algorithm"] = keyAlgorithm(csr.PublicKey)
+
+	storageEntry, err := certificateStorageEntry("sign", roleName, certificate, enrollment.Chain, responseMode, respData)
 
 	if err != nil {
 		return logical.ErrorResponse("error creating certificate storage entry"), err
@@ -184,8 +205,18 @@ func (b *backend) opWriteSign(ctx context.Context, req *logical.Request, data *f
 		return logical.ErrorResponse("could not store certificate"), err
 	}
 
+	if responseMode == responseModePKI {
+		addPKIResponseFields(respData, certificate, enrollment.Chain, *format)
+	}
+
+	respData["gateway_endpoint"] = enrollment.Endpoint
+	if useCSRValues {
+		respData["unmapped_csr_values"] = unmapped
+	}
+
 	return &logical.Response{
-		Data: respData,
+		Data:     respData,
+		Warnings: warnings,
 	}, nil
 
 }
@@ -21,14 +21,7 @@ func pathConfig(b *backend) *framework.Path {
 
 		HelpSynopsis:    "CAGW Configuration",
 		HelpDescription: "Configures CAGW parameters including client cert and key.",
-		Fields:          map[string]*framework.FieldSchema{},
-	}
-
-	ret.Fields["pem_bundle"] = &framework.FieldSchema{
-		Type:        framework.TypeString,
-		Default:     "",
-		Description: `PEM encoded client certificate and key.`,
-		Required:    true,
+		Fields:          addConnectionCommonFields(map[string]*framework.FieldSchema{}),
 	}
 
 	ret.Fields["roleName"] = &framework.FieldSchema{
@@ -52,18 +45,32 @@ func pathConfig(b *backend) *framework.Path {
 		Required:    false,
 	}
 
-	ret.Fields["url"] = &framework.FieldSchema{
-		Type:        framework.TypeString,
-		Default:     "",
-		Description: `URL for CAGW including base context path`,
-		Required:    true,
+	ret.Fields["allowed_profiles"] = &framework.FieldSchema{
+		Type: framework.TypeCommaStringSlice,
+		Description: "Profile identifiers, which may contain globs, that can be used with " +
+			"this role configuration. Only used when profile_id is not set. If empty, " +
+			"all profiles of the CA can be used.",
+	}
+
+	ret.Fields["default_profile"] = &framework.FieldSchema{
+		Type:    framework.TypeString,
+		Default: "",
+		Description: "Profile identifier to use when a request does not specify a profile. " +
+			"Only used when profile_id is not set.",
+	}
+
+	ret.Fields["response_mode"] = &framework.FieldSchema{
+		Type:    framework.TypeString,
+		Default: "",
+		Description: `Fields returned by issue and sign: "default" or "pki", which adds
+the response fields of the Vault PKI engine. Requests can override it.`,
 	}
 
-	ret.Fields["cacerts"] = &framework.FieldSchema{
+	ret.Fields["connection"] = &framework.FieldSchema{
 		Type:    framework.TypeString,
 		Default: "",
-		Description: "PEM encoded CA certificate chain. Not needed if the gateway's " +
-			"certificate is publicly trusted.",
+		Description: "Name of a stored gateway connection to use instead of the " +
+			"url, pem_bundle, pkcs12 and cacerts settings.",
 	}
 
 	return ret
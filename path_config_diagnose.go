@@ -0,0 +1,34 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathConfigDiagnose(b *backend) *framework.Path {
+	ret := &framework.Path{
+		Pattern: "config/" + framework.GenericNameRegex("roleName") + "/diagnose",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{Callback: b.opReadConfigDiagnose},
+		},
+
+		HelpSynopsis: "CAGW Connectivity Diagnostics",
+		HelpDescription: "Checks name resolution, the TLS handshake, client certificate acceptance, " +
+			"the CA lookup and the profile lookup for a role configuration and reports the " +
+			"outcome and duration of each step.",
+		Fields: map[string]*framework.FieldSchema{},
+	}
+
+	ret.Fields["roleName"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: `The name of the configured CAGW role`,
+	}
+
+	return ret
+}
@@ -0,0 +1,38 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathConfigRefresh(b *backend) *framework.Path {
+	ret := &framework.Path{
+		Pattern: "config/" + framework.GenericNameRegex("roleName") + "/refresh",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{Callback: b.opWriteConfigRefresh},
+		},
+
+		HelpSynopsis: "CAGW Profile Refresh",
+		HelpDescription: "Refreshes the profile configurations of a role from CAGW and reports " +
+			"the subject variables and subject alt names that were added, removed or changed.",
+		Fields: map[string]*framework.FieldSchema{},
+	}
+
+	ret.Fields["roleName"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: `The name of the configured CAGW role`,
+	}
+
+	ret.Fields["profile"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "The profile to refresh. If not set all configured profiles of the role are refreshed.",
+	}
+
+	return ret
+}
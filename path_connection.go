@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathConnections(b *backend) *framework.Path {
+	ret := &framework.Path{
+		Pattern: "connections/?$",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{Callback: b.opListConnections},
+		},
+
+		HelpSynopsis:    "List CAGW Connections",
+		HelpDescription: "Lists the names of the stored CAGW connections.",
+	}
+
+	return ret
+}
+
+func pathConnection(b *backend) *framework.Path {
+	ret := &framework.Path{
+		Pattern: "connections/" + framework.GenericNameRegex("name"),
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation:   &framework.PathOperation{Callback: b.opReadConnection},
+			logical.UpdateOperation: &framework.PathOperation{Callback: b.opWriteConnection},
+			logical.DeleteOperation: &framework.PathOperation{Callback: b.opDeleteConnection},
+		},
+
+		HelpSynopsis: "CAGW Connection",
+		HelpDescription: "Configures a CAGW URL, client cert and key and trust settings " +
+			"that can be shared by several role configurations.",
+		Fields: addConnectionCommonFields(map[string]*framework.FieldSchema{}),
+	}
+
+	ret.Fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Default:     "",
+		Description: `Connection identifier`,
+		Required:    true,
+	}
+
+	return ret
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathExport(b *backend) *framework.Path {
+	ret := &framework.Path{
+		Pattern: "export",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{Callback: b.opExportConfig},
+		},
+
+		HelpSynopsis: "Export Configuration",
+		HelpDescription: "Exports all connections, role configurations and profile configurations " +
+			"as a single JSON document.",
+		Fields: map[string]*framework.FieldSchema{},
+	}
+
+	ret.Fields["secrets"] = &framework.FieldSchema{
+		Type:    framework.TypeString,
+		Default: exportSecretsOmit,
+		Description: `How to export client credentials. Can be "include", "omit" or
+"encrypt". If "include" the credentials are exported in cleartext, if
+"encrypt" they are encrypted for public_key. Defaults to "omit".`,
+	}
+
+	ret.Fields["public_key"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Default:     "",
+		Description: "PEM encoded RSA public key used to encrypt the credentials.",
+	}
+
+	return ret
+}
+
+func pathImport(b *backend) *framework.Path {
+	ret := &framework.Path{
+		Pattern: "import",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{Callback: b.opImportConfig},
+		},
+
+		HelpSynopsis: "Import Configuration",
+		HelpDescription: "Imports connections, role configurations and profile configurations " +
+			"from a document created by the export endpoint.",
+		Fields: map[string]*framework.FieldSchema{},
+	}
+
+	ret.Fields["document"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Default:     "",
+		Description: "The JSON document returned by the export endpoint.",
+		Required:    true,
+	}
+
+	ret.Fields["conflict"] = &framework.FieldSchema{
+		Type:    framework.TypeString,
+		Default: importConflictFail,
+		Description: `What to do when an imported entry already exists. Can be "skip",
+"overwrite" or "fail". If "fail" nothing is imported when any entry
+exists. Defaults to "fail".`,
+	}
+
+	ret.Fields["dry_run"] = &framework.FieldSchema{
+		Type:        framework.TypeBool,
+		Default:     false,
+		Description: "If true, only report what would be imported.",
+	}
+
+	ret.Fields["private_key"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Default:     "",
+		Description: "PEM encoded RSA private key used to decrypt encrypted credentials.",
+	}
+
+	return ret
+}
@@ -22,7 +22,32 @@ func pathIssue(b *backend) *framework.Path {
 
 		HelpSynopsis:    "Certificate Enrollment",
 		HelpDescription: "Enroll for certificate.",
-		Fields:          addIssueAndSignCommonFields(map[string]*framework.FieldSchema{}),
+		Fields: addIssueAndSignCommonFields(map[string]*framework.FieldSchema{
+			"pkcs12_password": {
+				Type:        framework.TypeString,
+				Description: `Password protecting the returned PKCS#12. Required when format is "pkcs12".`,
+			},
+			"private_key_format": {
+				Type: framework.TypeString,
+				Description: `Format of the returned private key. Can be "pem" (PKCS#1 or SEC 1),
+"pkcs8", "der" (base64 encoded PKCS#1 or SEC 1) or "encrypted_pkcs8". Defaults
+to "der" if format is "der" and to "pem" otherwise.`,
+			},
+			"key_type": {
+				Type: framework.TypeString,
+				Description: `Type of a key pair to generate in the plugin: "rsa", "ec" or "ed25519".
+Only the CSR is sent to CAGW. If not set CAGW generates the key.`,
+			},
+			"key_bits": {
+				Type: framework.TypeInt,
+				Description: `Size of the generated key: 2048 (default), 3072 or 4096 for "rsa" and
+256 (default), 384 or 521 for "ec".`,
+			},
+			"private_key_passphrase": {
+				Type:        framework.TypeString,
+				Description: `Passphrase encrypting the returned private key. Required when private_key_format is "encrypted_pkcs8".`,
+			},
+		}),
 	}
 
 	return ret
@@ -32,5 +32,11 @@ func pathSign(b *backend) *framework.Path {
 		Required:    true,
 	}
 
+	ret.Fields["use_csr_values"] = &framework.FieldSchema{
+		Type: framework.TypeBool,
+		Description: "If true, the subject variables and SANs that are not requested " +
+			"explicitly are taken from the CSR. Defaults to the setting of the profile.",
+	}
+
 	return ret
 }
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+)
+
+const (
+	responseModeDefault = "default"
+	responseModePKI     = "pki"
+)
+
+var responseModes = []string{responseModeDefault, responseModePKI}
+
+// getResponseMode returns the response mode requested, or else the one of the
+// role configuration.
+func getResponseMode(data *framework.FieldData, configRole *CAGWConfigRole) (string, error) {
+	responseMode := data.Get("response_mode").(string)
+	if len(responseMode) == 0 {
+		responseMode = configRole.ResponseMode
+	}
+	if len(responseMode) == 0 {
+		return responseModeDefault, nil
+	}
+	if !strutil.StrListContains(responseModes, responseMode) {
+		return "", errors.Errorf("Invalid response mode: %s", responseMode)
+	}
+	return responseMode, nil
+}
+
+// addPKIResponseFields adds the response fields of the Vault PKI engine:
+// issuing_ca, ca_chain, expiration and serial_number in hex with colons. The
+// certificates are base64 encoded DER for the der format and PEM otherwise.
+// Certificates are still stored under the decimal serial number, so the
+// storage entry must be created before the fields are added.
+func addPKIResponseFields(respData map[string]interface{}, certificate *x509.Certificate, caCerts []*x509.Certificate, format string) {
+	encode := func(c *x509.Certificate) string {
+		if format == "der" {
+			return base64.StdEncoding.EncodeToString(c.Raw)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}))
+	}
+
+	caChain := []string{}
+	for _, c := range caCerts {
+		caChain = append(caChain, encode(c))
+	}
+	respData["ca_chain"] = caChain
+
+	respData["issuing_ca"] = ""
+	if issuer := issuingCA(certificate, caCerts); issuer != nil {
+		respData["issuing_ca"] = encode(issuer)
+	}
+
+	respData["expiration"] = certificate.NotAfter.Unix()
+	respData["serial_number"] = certutil.GetHexFormatted(certificate.SerialNumber.Bytes(), ":")
+}
+
+// issuingCA returns the certificate of the chain that issued the certificate,
+// whatever the order of the chain. The issuer is matched by key identifier
+// and otherwise by name. Nil is returned if the chain does not contain it.
+func issuingCA(certificate *x509.Certificate, caCerts []*x509.Certificate) *x509.Certificate {
+	if len(certificate.AuthorityKeyId) > 0 {
+		for _, c := range caCerts {
+			if bytes.Equal(c.SubjectKeyId, certificate.AuthorityKeyId) {
+				return c
+			}
+		}
+	}
+	for _, c := range caCerts {
+		if bytes.Equal(c.RawSubject, certificate.RawIssuer) {
+			return c
+		}
+	}
+	return nil
+}
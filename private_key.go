@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/youmark/pkcs8"
+)
+
+var privateKeyFormats = []string{"pem", "pkcs8", "der", "encrypted_pkcs8"}
+
+// keyTypes are the key types that can be generated locally on issue
+var keyTypes = []string{"rsa", "ec", "ed25519"}
+
+// ecCurves are the names of the supported EC curves
+var ecCurves = []string{"P-256", "P-384", "P-521"}
+
+// signatureAlgorithmKnown tells if the name is that of a signature algorithm
+// x509 can verify.
+func signatureAlgorithmKnown(name string) bool {
+	for algorithm := x509.MD2WithRSA; algorithm <= x509.PureEd25519; algorithm++ {
+		if strings.EqualFold(algorithm.String(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// generatePrivateKey generates a key pair of the given type. The size defaults
+// to 2048 bits for RSA and to P-256 for EC, Ed25519 has a fixed size.
+func generatePrivateKey(keyType string, keyBits int) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa":
+		switch keyBits {
+		case 0:
+			keyBits = 2048
+		case 2048, 3072, 4096:
+		default:
+			return nil, errors.Errorf("unsupported RSA key size: %d", keyBits)
+		}
+		return rsa.GenerateKey(rand.Reader, keyBits)
+
+	case "ec":
+		var curve elliptic.Curve
+		switch keyBits {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported EC key size: %d", keyBits)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+
+	case "ed25519":
+		if keyBits != 0 {
+			return nil, errors.New("key_bits cannot be set for ed25519 keys")
+		}
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+
+	return nil, errors.Errorf("unsupported key type: %s", keyType)
+}
+
+// privateKeyType returns the key type reported as private_key_type.
+func privateKeyType(key crypto.PrivateKey) (string, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa", nil
+	case *ecdsa.PrivateKey:
+		return "ec", nil
+	case ed25519.PrivateKey:
+		return "ed25519", nil
+	}
+	return "", errors.New("unsupported private key type")
+}
+
+// publicKeyType returns the key type of a public key in the terms of
+// allowed_key_types.
+func publicKeyType(publicKey crypto.PublicKey) string {
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		return "rsa"
+	case *ecdsa.PublicKey:
+		return "ec"
+	case ed25519.PublicKey:
+		return "ed25519"
+	}
+	return "unknown"
+}
+
+// keyAlgorithm describes the algorithm and size of a public key, for example
+// "RSA 2048", "ECDSA P-256" or "Ed25519".
+func keyAlgorithm(publicKey crypto.PublicKey) string {
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return "unknown"
+}
+
+// parsePEMPrivateKey parses an unencrypted PKCS#1, SEC 1 or PKCS#8 private key.
+// Ed25519 keys only exist as PKCS#8.
+func parsePEMPrivateKey(pemKey string) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("private key could not be decoded")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, errors.Errorf("unsupported private key block: %s", block.Type)
+}
+
+// encodePrivateKey encodes a PEM private key in the given private key format.
+// "pem" keeps the key as is, "der" returns the same key base64 encoded,
+// "pkcs8" converts it to PKCS#8 PEM and "encrypted_pkcs8" to PKCS#8 PEM
+// encrypted with the passphrase.
+func encodePrivateKey(pemKey string, format string, passphrase string) (string, error) {
+	if format == "pem" {
+		return pemKey, nil
+	}
+
+	if format == "der" {
+		block, _ := pem.Decode([]byte(pemKey))
+		if block == nil {
+			return "", errors.New("private key could not be decoded")
+		}
+		return base64.StdEncoding.EncodeToString(block.Bytes), nil
+	}
+
+	key, err := parsePEMPrivateKey(pemKey)
+	if err != nil {
+		return "", err
+	}
+
+	var block *pem.Block
+	switch format {
+	case "pkcs8":
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return "", errors.Wrap(err, "error encoding private key as PKCS#8")
+		}
+		block = &pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: keyBytes,
+		}
+	case "encrypted_pkcs8":
+		keyBytes, err := pkcs8.ConvertPrivateKeyToPKCS8(key, []byte(passphrase))
+		if err != nil {
+			return "", errors.Wrap(err, "error encrypting private key")
+		}
+		block = &pem.Block{
+			Type:  "ENCRYPTED PRIVATE KEY",
+			Bytes: keyBytes,
+		}
+	default:
+		return "", errors.Errorf("invalid private key format: %s", format)
+	}
+
+	return string(pem.EncodeToMemory(block)), nil
+}
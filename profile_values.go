@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/vault/helper/identity"
+	"github.com/hashicorp/vault/helper/namespace"
+	"github.com/hashicorp/vault/logical"
+	"github.com/pkg/errors"
+)
+
+// groupTemplate matches the identity templates that take a value from the
+// groups of the entity.
+var groupTemplate = regexp.MustCompile(`\{\{\s*identity\.groups\b`)
+
+// errGroupTemplate rejects group templates, which cannot be resolved as the
+// plugin API does not expose the groups of the entity.
+var errGroupTemplate = errors.New("group templates are not supported: Vault does not provide the groups of the entity to plugins")
+
+// requestEntity returns the identity entity of the caller in the form used by
+// the Vault identity templating, or nil if the token has no entity. The
+// SystemView of the Vault 1.1 plugin API has no group lookup, so the groups of
+// the entity cannot be resolved; supporting group templates needs a Vault SDK
+// whose SystemView provides GroupsForEntity.
+func (b *backend) requestEntity(req *logical.Request) (*identity.Entity, error) {
+	if len(req.EntityID) == 0 {
+		return nil, nil
+	}
+
+	entityInfo, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if entityInfo == nil {
+		return nil, nil
+	}
+
+	entity := &identity.Entity{
+		ID:       entityInfo.ID,
+		Name:     entityInfo.Name,
+		Metadata: entityInfo.Metadata,
+	}
+	for _, a := range entityInfo.Aliases {
+		entity.Aliases = append(entity.Aliases, &identity.Alias{
+			MountType:     a.MountType,
+			MountAccessor: a.MountAccessor,
+			Name:          a.Name,
+			Metadata:      a.Metadata,
+		})
+	}
+	return entity, nil
+}
+
+// populateTemplate resolves the identity templates in a value, for example
+// {{identity.entity.name}} or {{identity.entity.aliases.<mount accessor>.metadata.<key>}}.
+func populateTemplate(value string, entity *identity.Entity) (string, error) {
+	if groupTemplate.MatchString(value) {
+		return "", fmt.Errorf("error resolving template %q: %s", value, errGroupTemplate)
+	}
+	_, populated, err := identity.PopulateString(&identity.PopulateStringInput{
+		String:    value,
+		Entity:    entity,
+		Namespace: namespace.RootNamespace,
+	})
+	if err != nil {
+		return "", fmt.Errorf("error resolving template %q: %s", value, err)
+	}
+	return populated, nil
+}
+
+// validateTemplate checks that a value configured on a profile is a well
+// formed template that can be resolved, which excludes group templates.
+func validateTemplate(value string) error {
+	if groupTemplate.MatchString(value) {
+		return fmt.Errorf("invalid template %q: %s", value, errGroupTemplate)
+	}
+	_, _, err := identity.PopulateString(&identity.PopulateStringInput{
+		ValidityCheckOnly: true,
+		String:            value,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid template %q: %s", value, err)
+	}
+	return nil
+}
+
+// profileSubjectVariables parses subject variables configured on the profile
+// and resolves their templates.
+func profileSubjectVariables(subjectVariables string, entity *identity.Entity) ([]SubjectVariable, error) {
+	if len(subjectVariables) == 0 {
+		return nil, nil
+	}
+
+	vars, err := processSubjectVariables(subjectVariables)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vars {
+		if vars[i].Value, err = populateTemplate(vars[i].Value, entity); err != nil {
+			return nil, err
+		}
+	}
+	return vars, nil
+}
+
+// profileAltNames resolves the templates of SANs configured on the profile and
+// parses them like alt_names.
+func (p *CAGWConfigProfile) profileAltNames(altNames []string, entity *identity.Entity) ([]SubjectAltName, error) {
+	populated := make([]string, 0, len(altNames))
+	for _, name := range altNames {
+		value, err := populateTemplate(name, entity)
+		if err != nil {
+			return nil, err
+		}
+		populated = append(populated, value)
+	}
+	return processSubjectAltNames(populated, p)
+}
+
+// applyFixedValues adds the fixed subject variables and SANs of the profile to
+// a request. Every requested value of a fixed subject variable that differs
+// from the fixed values is reported as a violation, and the requested values
+// of a fixed subject variable are replaced by the fixed ones, so that
+// repeating a variable cannot add a value.
+func (p *CAGWConfigProfile) applyFixedValues(subjectVars []SubjectVariable, altNames []SubjectAltName, entity *identity.Entity) ([]SubjectVariable, []SubjectAltName, []string, error) {
+	var violations []string
+
+	fixedVars, err := profileSubjectVariables(p.FixedSubjectVariables, entity)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	fixedValues := map[string][]SubjectVariable{}
+	var fixedTypes []string
+	for _, fixed := range fixedVars {
+		key := strings.ToLower(fixed.Type)
+		if _, ok := fixedValues[key]; !ok {
+			fixedTypes = append(fixedTypes, key)
+		}
+		fixedValues[key] = append(fixedValues[key], fixed)
+	}
+
+	var vars []SubjectVariable
+	applied := map[string]bool{}
+	reported := map[string]bool{}
+	for _, v := range subjectVars {
+		key := strings.ToLower(v.Type)
+		fixed, ok := fixedValues[key]
+		if !ok {
+			vars = append(vars, v)
+			continue
+		}
+		if !containsSubjectVariableValue(fixed, v.Value) && !reported[key] {
+			reported[key] = true
+			violations = append(violations, fmt.Sprintf("subject variable %s is fixed to %s by the profile", fixed[0].Type, subjectVariableValues(fixed)))
+		}
+		if !applied[key] {
+			vars = append(vars, fixed...)
+			applied[key] = true
+		}
+	}
+	for _, key := range fixedTypes {
+		if !applied[key] {
+			vars = append(vars, fixedValues[key]...)
+		}
+	}
+	subjectVars = vars
+
+	fixedAltNames, err := p.profileAltNames(p.FixedAltNames, entity)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, fixed := range fixedAltNames {
+		if !containsAltName(altNames, fixed.Value) {
+			altNames = append(altNames, fixed)
+		}
+	}
+
+	return subjectVars, altNames, violations, nil
+}
+
+// applyDefaultValues adds the default subject variables of the profile that
+// are not requested and the default SANs that are not already present.
+func (p *CAGWConfigProfile) applyDefaultValues(subjectVars []SubjectVariable, altNames []SubjectAltName, entity *identity.Entity) ([]SubjectVariable, []SubjectAltName, error) {
+	defaultVars, err := profileSubjectVariables(p.DefaultSubjectVariables, entity)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, v := range defaultVars {
+		if !containsSubjectVariable(subjectVars, v.Type) {
+			subjectVars = append(subjectVars, v)
+		}
+	}
+
+	defaultAltNames, err := p.profileAltNames(p.DefaultAltNames, entity)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, a := range defaultAltNames {
+		if !containsAltName(altNames, a.Value) {
+			altNames = append(altNames, a)
+		}
+	}
+
+	return subjectVars, altNames, nil
+}
+
+func containsSubjectVariableValue(subjectVars []SubjectVariable, value string) bool {
+	for _, v := range subjectVars {
+		if v.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+func subjectVariableValues(subjectVars []SubjectVariable) string {
+	values := make([]string, 0, len(subjectVars))
+	for _, v := range subjectVars {
+		values = append(values, v.Value)
+	}
+	return strings.Join(values, ", ")
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyFixedValues(t *testing.T) {
+	tests := []struct {
+		name        string
+		fixed       string
+		subjectVars []SubjectVariable
+		want        []SubjectVariable
+		violations  []string
+	}{
+		{
+			name:        "fixed variable is added",
+			fixed:       "o=Acme",
+			subjectVars: []SubjectVariable{{Type: "cn", Value: "www.example.com"}},
+			want:        []SubjectVariable{{Type: "cn", Value: "www.example.com"}, {Type: "o", Value: "Acme"}},
+		},
+		{
+			name:        "requested fixed value is kept once",
+			fixed:       "o=Acme",
+			subjectVars: []SubjectVariable{{Type: "O", Value: "Acme"}, {Type: "cn", Value: "www.example.com"}, {Type: "o", Value: "Acme"}},
+			want:        []SubjectVariable{{Type: "o", Value: "Acme"}, {Type: "cn", Value: "www.example.com"}},
+		},
+		{
+			name:        "different value is rejected",
+			fixed:       "o=Acme",
+			subjectVars: []SubjectVariable{{Type: "o", Value: "Evil"}},
+			want:        []SubjectVariable{{Type: "o", Value: "Acme"}},
+			violations:  []string{"subject variable o is fixed to Acme by the profile"},
+		},
+		{
+			name:        "different value after the fixed one is rejected",
+			fixed:       "o=Acme",
+			subjectVars: []SubjectVariable{{Type: "o", Value: "Acme"}, {Type: "o", Value: "Evil"}, {Type: "o", Value: "Other"}},
+			want:        []SubjectVariable{{Type: "o", Value: "Acme"}},
+			violations:  []string{"subject variable o is fixed to Acme by the profile"},
+		},
+		{
+			name:        "repeated fixed variable",
+			fixed:       "ou=Web,ou=Ops",
+			subjectVars: []SubjectVariable{{Type: "ou", Value: "Ops"}},
+			want:        []SubjectVariable{{Type: "ou", Value: "Web"}, {Type: "ou", Value: "Ops"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := CAGWConfigProfile{FixedSubjectVariables: tt.fixed}
+			subjectVars, _, violations, err := profile.applyFixedValues(tt.subjectVars, nil, nil)
+			if err != nil {
+				t.Fatalf("applyFixedValues() failed: %v", err)
+			}
+			if !reflect.DeepEqual(subjectVars, tt.want) {
+				t.Errorf("subject variables = %v, want %v", subjectVars, tt.want)
+			}
+			if !reflect.DeepEqual(violations, tt.violations) {
+				t.Errorf("violations = %q, want %q", violations, tt.violations)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/hashicorp/vault/helper/jsonutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/pkg/errors"
+)
+
+// storageSchemaVersion is the layout version written with every storage
+// entry. Entries without a version were written before versioning was
+// introduced and use the legacy layout: role configurations and connections
+// keyed by Go field names and certificates with a numeric serial number.
+const storageSchemaVersion = 1
+
+// storageSchemaKey holds the schema version the whole mount was migrated to.
+const storageSchemaKey = "storage_schema"
+
+type storageSchema struct {
+	Version int `json:"version"`
+}
+
+type connectionEntry struct {
+	SchemaVersion int `json:"schema_version"`
+	CAGWConnection
+}
+
+// certificateEntry holds the fields of an issue or sign response that are
+// returned again when the certificate is read. The CA chain is kept as a list
+// only for the pki response mode, whose fields are derived from it on read.
+type certificateEntry struct {
+	SchemaVersion   int      `json:"schema_version"`
+	SerialNumber    string   `json:"serial_number"`
+	Certificate     string   `json:"certificate"`
+	PrivateKey      string   `json:"private_key,omitempty"`
+	PrivateKeyType  string   `json:"private_key_type,omitempty"`
+	Chain           string   `json:"chain,omitempty"`
+	KeyAlgorithm    string   `json:"key_algorithm,omitempty"`
+	CSRKeyAlgorithm string   `json:"csr_key_algorithm,omitempty"`
+	ResponseMode    string   `json:"response_mode,omitempty"`
+	CAChain         []string `json:"ca_chain,omitempty"`
+}
+
+type legacyConfigRole struct {
+	PEMBundle       string
+	PKCS12          string
+	PKCS12Password  string
+	KeyPassword     string
+	URL             string
+	CACerts         string
+	Connection      string
+	CAId            string
+	ProfileId       string
+	AllowedProfiles []string
+	DefaultProfile  string
+	// Profile IDs decode from the legacy layout as the JSON decoder matches
+	// "Id" and "Name" case-insensitively
+	Profiles []CAGWConfigProfileID
+}
+
+type legacyConnection struct {
+	PEMBundle      string
+	PKCS12         string
+	PKCS12Password string
+	KeyPassword    string
+	URL            string
+	CACerts        string
+}
+
+type legacyCertificateEntry struct {
+	SerialNumber *big.Int `json:"serial_number"`
+	Certificate  string   `json:"certificate"`
+	PrivateKey   string   `json:"private_key"`
+	Chain        string   `json:"chain"`
+}
+
+func decodeConfigRole(raw []byte) (*CAGWConfigCAConfigProfileIDs, error) {
+	var configRole CAGWConfigCAConfigProfileIDs
+	if err := jsonutil.DecodeJSON(raw, &configRole); err != nil {
+		return nil, err
+	}
+	if configRole.SchemaVersion > 0 {
+		return &configRole, nil
+	}
+
+	var legacy legacyConfigRole
+	if err := jsonutil.DecodeJSON(raw, &legacy); err != nil {
+		return nil, err
+	}
+
+	configRole = CAGWConfigCAConfigProfileIDs{
+		SchemaVersion: storageSchemaVersion,
+		CAGWConfigRole: CAGWConfigRole{
+			CAGWConnection: CAGWConnection{
+				PEMBundle:      legacy.PEMBundle,
+				PKCS12:         legacy.PKCS12,
+				PKCS12Password: legacy.PKCS12Password,
+				KeyPassword:    legacy.KeyPassword,
+				URL:            legacy.URL,
+				CACerts:        legacy.CACerts,
+			},
+			Connection:      legacy.Connection,
+			CAId:            legacy.CAId,
+			ProfileId:       legacy.ProfileId,
+			AllowedProfiles: legacy.AllowedProfiles,
+			DefaultProfile:  legacy.DefaultProfile,
+		},
+		Profiles: legacy.Profiles,
+	}
+
+	return &configRole, nil
+}
+
+func decodeConnection(raw []byte) (*CAGWConnection, error) {
+	var entry connectionEntry
+	if err := jsonutil.DecodeJSON(raw, &entry); err != nil {
+		return nil, err
+	}
+	if entry.SchemaVersion > 0 {
+		return &entry.CAGWConnection, nil
+	}
+
+	var legacy legacyConnection
+	if err := jsonutil.DecodeJSON(raw, &legacy); err != nil {
+		return nil, err
+	}
+
+	return &CAGWConnection{
+		PEMBundle:      legacy.PEMBundle,
+		PKCS12:         legacy.PKCS12,
+		PKCS12Password: legacy.PKCS12Password,
+		KeyPassword:    legacy.KeyPassword,
+		URL:            legacy.URL,
+		CACerts:        legacy.CACerts,
+	}, nil
+}
+
+func decodeConfigProfile(raw []byte) (*CAGWConfigProfile, error) {
+	// The profile layout did not change, it only gained a version
+	var configProfile CAGWConfigProfile
+	if err := jsonutil.DecodeJSON(raw, &configProfile); err != nil {
+		return nil, err
+	}
+	configProfile.SchemaVersion = storageSchemaVersion
+	return &configProfile, nil
+}
+
+func decodeCertificateEntry(raw []byte) (*certificateEntry, error) {
+	var entry certificateEntry
+	if err := jsonutil.DecodeJSON(raw, &entry); err == nil && entry.SchemaVersion > 0 {
+		return &entry, nil
+	}
+
+	var legacy legacyCertificateEntry
+	if err := jsonutil.DecodeJSON(raw, &legacy); err != nil {
+		return nil, err
+	}
+
+	entry = certificateEntry{
+		SchemaVersion: storageSchemaVersion,
+		Certificate:   legacy.Certificate,
+		PrivateKey:    legacy.PrivateKey,
+		Chain:         legacy.Chain,
+	}
+	if legacy.SerialNumber != nil {
+		entry.SerialNumber = legacy.SerialNumber.String()
+	}
+
+	return &entry, nil
+}
+
+func connectionStorageEntry(name string, connection *CAGWConnection) (*logical.StorageEntry, error) {
+	return logical.StorageEntryJSON("connections/"+name, connectionEntry{
+		SchemaVersion:  storageSchemaVersion,
+		CAGWConnection: *connection,
+	})
+}
+
+func configRoleStorageEntry(roleName string, configRole *CAGWConfigCAConfigProfileIDs) (*logical.StorageEntry, error) {
+	configRole.SchemaVersion = storageSchemaVersion
+	return logical.StorageEntryJSON("config/"+roleName, configRole)
+}
+
+func configProfileStorageEntry(roleName string, configProfile *CAGWConfigProfile) (*logical.StorageEntry, error) {
+	configProfile.SchemaVersion = storageSchemaVersion
+	return logical.StorageEntryJSON("config/"+roleName+"/profiles/"+configProfile.Id, configProfile)
+}
+
+// certificateStorageEntry stores the certificate, chain, private key and key
+// details of an issue or sign response under the decimal serial number of the
+// certificate. The serial number is taken from the certificate, so the
+// response fields may be in any format.
+func certificateStorageEntry(path string, roleName string, certificate *x509.Certificate, caCerts []*x509.Certificate, responseMode string, respData map[string]interface{}) (*logical.StorageEntry, error) {
+	if certificate == nil || certificate.SerialNumber == nil {
+		return nil, errors.New("missing certificate serial number")
+	}
+
+	entry := certificateEntry{
+		SchemaVersion: storageSchemaVersion,
+		SerialNumber:  certificate.SerialNumber.String(),
+		ResponseMode:  responseMode,
+	}
+	entry.Certificate, _ = respData["certificate"].(string)
+	entry.PrivateKey, _ = respData["private_key"].(string)
+	entry.PrivateKeyType, _ = respData["private_key_type"].(string)
+	entry.Chain, _ = respData["chain"].(string)
+	entry.KeyAlgorithm, _ = respData["key_algorithm"].(string)
+	entry.CSRKeyAlgorithm, _ = respData["csr_key_algorithm"].(string)
+	if responseMode == responseModePKI {
+		for _, c := range caCerts {
+			entry.CAChain = append(entry.CAChain, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})))
+		}
+	}
+
+	return logical.StorageEntryJSON(path+"/"+roleName+"/"+entry.SerialNumber, entry)
+}
+
+// migrateStorage rewrites every entry stored with an older layout in the
+// current layout. Nodes that cannot write to the storage of the mount, such
+// as performance standbys and replication secondaries, leave the migration to
+// the primary and read both layouts until it is replicated.
+func (b *backend) migrateStorage(ctx context.Context, storage logical.Storage) error {
+	if storage == nil {
+		return nil
+	}
+	if !b.writesStorage() {
+		return nil
+	}
+
+	schemaEntry, err := storage.Get(ctx, storageSchemaKey)
+	if err != nil {
+		return errors.Wrap(err, "could not read the storage schema version")
+	}
+	var schema storageSchema
+	if schemaEntry != nil {
+		if err := schemaEntry.DecodeJSON(&schema); err != nil {
+			return errors.Wrap(err, "could not parse the storage schema version")
+		}
+	}
+	if schema.Version >= storageSchemaVersion {
+		return nil
+	}
+
+	b.Logger().Info(fmt.Sprintf("Migrating storage from schema version %d to %d", schema.Version, storageSchemaVersion))
+
+	// Entries that cannot be parsed are left as they are and the schema
+	// version is not bumped, so that the next start tries them again
+	skipped := 0
+	migrate := func(key string, decode func([]byte) (interface{}, error)) error {
+		entry, err := storage.Get(ctx, key)
+		if err != nil {
+			return errors.Wrapf(err, "%s could not be loaded", key)
+		}
+		if entry == nil {
+			return nil
+		}
+		value, err := decode(entry.Value)
+		if err != nil {
+			b.Logger().Error(fmt.Sprintf("Skipping the migration of %s as it could not be parsed", key), "error", err)
+			skipped++
+			return nil
+		}
+		newEntry, err := logical.StorageEntryJSON(key, value)
+		if err != nil {
+			return errors.Wrapf(err, "%s could not be encoded", key)
+		}
+		return storage.Put(ctx, newEntry)
+	}
+
+	connectionNames, err := storage.List(ctx, "connections/")
+	if err != nil {
+		return err
+	}
+	for _, name := range connectionNames {
+		err := migrate("connections/"+name, func(raw []byte) (interface{}, error) {
+			connection, err := decodeConnection(raw)
+			if err != nil {
+				return nil, err
+			}
+			return connectionEntry{storageSchemaVersion, *connection}, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	roleNames, err := storage.List(ctx, "config/")
+	if err != nil {
+		return err
+	}
+	for _, roleName := range roleNames {
+		if strings.HasSuffix(roleName, "/") {
+			profileIds, err := storage.List(ctx, "config/"+roleName+"profiles/")
+			if err != nil {
+				return err
+			}
+			for _, profileId := range profileIds {
+				err := migrate("config/"+roleName+"profiles/"+profileId, func(raw []byte) (interface{}, error) {
+					return decodeConfigProfile(raw)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		err := migrate("config/"+roleName, func(raw []byte) (interface{}, error) {
+			return decodeConfigRole(raw)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, path := range []string{"issue/", "sign/"} {
+		roleDirs, err := storage.List(ctx, path)
+		if err != nil {
+			return err
+		}
+		for _, roleDir := range roleDirs {
+			serials, err := storage.List(ctx, path+roleDir)
+			if err != nil {
+				return err
+			}
+			for _, serial := range serials {
+				err := migrate(path+roleDir+serial, func(raw []byte) (interface{}, error) {
+					return decodeCertificateEntry(raw)
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if skipped > 0 {
+		b.Logger().Warn(fmt.Sprintf("%d entries could not be migrated, the migration is retried on the next start", skipped))
+		return nil
+	}
+
+	schemaEntry, err = logical.StorageEntryJSON(storageSchemaKey, storageSchema{storageSchemaVersion})
+	if err != nil {
+		return err
+	}
+	return storage.Put(ctx, schemaEntry)
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func putRawEntry(t *testing.T, storage logical.Storage, key string, value string) {
+	t.Helper()
+	if err := storage.Put(context.Background(), &logical.StorageEntry{Key: key, Value: []byte(value)}); err != nil {
+		t.Fatalf("could not write %s: %v", key, err)
+	}
+}
+
+func getRawEntry(t *testing.T, storage logical.Storage, key string) map[string]interface{} {
+	t.Helper()
+	entry, err := storage.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("could not read %s: %v", key, err)
+	}
+	if entry == nil {
+		t.Fatalf("%s is missing", key)
+	}
+	var value map[string]interface{}
+	if err := json.Unmarshal(entry.Value, &value); err != nil {
+		t.Fatalf("could not parse %s: %v", key, err)
+	}
+	return value
+}
+
+func TestMigrateStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+
+	// Entries in the layout written before versioning was introduced
+	putRawEntry(t, storage, "connections/gateway01",
+		`{"PEMBundle":"bundle","KeyPassword":"secret","URL":"https://gateway01/cagw","CACerts":"cacerts"}`)
+	putRawEntry(t, storage, "config/role01",
+		`{"PKCS12":"pkcs12","PKCS12Password":"password","URL":"https://cagw/cagw","Connection":"gateway01",`+
+			`"CAId":"CA01","ProfileId":"profile01","AllowedProfiles":["profile01","profile02"],"DefaultProfile":"profile01",`+
+			`"Profiles":[{"Id":"profile01","Name":"Profile 01"}]}`)
+	putRawEntry(t, storage, "config/role01/profiles/profile01",
+		`{"id":"profile01","name":"Profile 01","ttl_duration":3600000000000}`)
+	putRawEntry(t, storage, "issue/role01/123456789012345678901234567890",
+		`{"serial_number":123456789012345678901234567890,"certificate":"cert","private_key":"key","chain":"chain"}`)
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+	b, err := Factory(ctx, config)
+	if err != nil {
+		t.Fatalf("Factory failed: %v", err)
+	}
+	if b == nil {
+		t.Fatal("Factory returned no backend")
+	}
+
+	schema := getRawEntry(t, storage, storageSchemaKey)
+	if schema["version"] != float64(storageSchemaVersion) {
+		t.Errorf("storage schema version = %v, want %d", schema["version"], storageSchemaVersion)
+	}
+
+	connection, err := getConnection(ctx, storage, "gateway01")
+	if err != nil {
+		t.Fatalf("could not read the migrated connection: %v", err)
+	}
+	if connection.PEMBundle != "bundle" || connection.KeyPassword != "secret" ||
+		connection.URL != "https://gateway01/cagw" || connection.CACerts != "cacerts" {
+		t.Errorf("unexpected migrated connection: %+v", connection)
+	}
+	if raw := getRawEntry(t, storage, "connections/gateway01"); raw["schema_version"] != float64(storageSchemaVersion) {
+		t.Errorf("connection schema_version = %v, want %d", raw["schema_version"], storageSchemaVersion)
+	}
+
+	configRole, err := getStoredConfigRole(ctx, storage, "role01")
+	if err != nil {
+		t.Fatalf("could not read the migrated role configuration: %v", err)
+	}
+	if configRole.PKCS12 != "pkcs12" || configRole.PKCS12Password != "password" ||
+		configRole.Connection != "gateway01" || configRole.CAId != "CA01" ||
+		configRole.ProfileId != "profile01" || configRole.DefaultProfile != "profile01" {
+		t.Errorf("unexpected migrated role configuration: %+v", configRole)
+	}
+	if len(configRole.AllowedProfiles) != 2 || configRole.AllowedProfiles[1] != "profile02" {
+		t.Errorf("allowed profiles = %v, want [profile01 profile02]", configRole.AllowedProfiles)
+	}
+	if len(configRole.Profiles) != 1 || configRole.Profiles[0].Id != "profile01" || configRole.Profiles[0].Name != "Profile 01" {
+		t.Errorf("profiles = %+v, want profile01", configRole.Profiles)
+	}
+	if raw := getRawEntry(t, storage, "config/role01"); raw["schema_version"] != float64(storageSchemaVersion) {
+		t.Errorf("role configuration schema_version = %v, want %d", raw["schema_version"], storageSchemaVersion)
+	}
+
+	profile := getRawEntry(t, storage, "config/role01/profiles/profile01")
+	if profile["schema_version"] != float64(storageSchemaVersion) || profile["id"] != "profile01" ||
+		profile["ttl_duration"] != float64(3600000000000) {
+		t.Errorf("unexpected migrated profile configuration: %v", profile)
+	}
+
+	certificate := getRawEntry(t, storage, "issue/role01/123456789012345678901234567890")
+	if certificate["serial_number"] != "123456789012345678901234567890" {
+		t.Errorf("certificate serial_number = %v, want the decimal string", certificate["serial_number"])
+	}
+	if certificate["schema_version"] != float64(storageSchemaVersion) || certificate["certificate"] != "cert" ||
+		certificate["private_key"] != "key" || certificate["chain"] != "chain" {
+		t.Errorf("unexpected migrated certificate entry: %v", certificate)
+	}
+}
+
+func TestMigrateStorageSkipsMigratedStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+
+	putRawEntry(t, storage, storageSchemaKey, `{"version":1}`)
+	putRawEntry(t, storage, "connections/gateway01", `{"URL":"https://gateway01/cagw"}`)
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+	if _, err := Factory(ctx, config); err != nil {
+		t.Fatalf("Factory failed: %v", err)
+	}
+
+	if raw := getRawEntry(t, storage, "connections/gateway01"); raw["schema_version"] != nil {
+		t.Errorf("an up to date mount was migrated again: %v", raw)
+	}
+}
+
+func TestMigrateStorageSkipsUnparseableEntries(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+
+	putRawEntry(t, storage, "config/role01", `not json`)
+	putRawEntry(t, storage, "connections/gateway01", `{"URL":"https://gateway01/cagw"}`)
+
+	config := logical.TestBackendConfig()
+	config.StorageView = storage
+	if _, err := Factory(ctx, config); err != nil {
+		t.Fatalf("Factory failed: %v", err)
+	}
+
+	if raw := getRawEntry(t, storage, "connections/gateway01"); raw["schema_version"] != float64(storageSchemaVersion) {
+		t.Errorf("connection schema_version = %v, want %d", raw["schema_version"], storageSchemaVersion)
+	}
+	if entry, _ := storage.Get(ctx, "config/role01"); entry == nil || string(entry.Value) != "not json" {
+		t.Errorf("the unparseable entry was modified: %v", entry)
+	}
+	if entry, _ := storage.Get(ctx, storageSchemaKey); entry != nil {
+		t.Errorf("the storage schema version was written although an entry was skipped")
+	}
+}
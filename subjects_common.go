@@ -6,9 +6,14 @@
 package main
 
 import (
+	"crypto/x509"
 	"fmt"
+	"net"
+	"net/url"
 	"strings"
 
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
 	"gopkg.in/ldap.v2"
 )
 
@@ -30,16 +35,201 @@ func processSubjectVariables(subjectVars string) ([]SubjectVariable, error) {
 	return subjectVariables, nil
 }
 
-func processSubjectAltNames(subjectAltNames []string) ([]SubjectAltName, error) {
+// processSubjectAltNames parses the SANs given with alt_names. A SAN with the
+// type and value separated by the equal sign is passed on as is; a SAN without
+// a type, as sent to the Vault PKI engine, is a DNS name or an email address.
+func processSubjectAltNames(subjectAltNames []string, configProfile *CAGWConfigProfile) ([]SubjectAltName, error) {
 	var altNames []SubjectAltName
 
 	for _, tv := range subjectAltNames {
 		out := strings.SplitN(tv, "=", 2)
 		if len(out) != 2 {
-			return nil, fmt.Errorf("error parsing the subject alt names: %s", subjectAltNames)
+			altNames = append(altNames, SubjectAltName{Type: configProfile.sanTypeForName(tv), Value: tv})
+			continue
 		}
 		altNames = append(altNames, SubjectAltName{Type: out[0], Value: out[1]})
 	}
 
 	return altNames, nil
 }
+
+// processPKIFields maps the Vault PKI style request fields common_name,
+// ip_sans, uri_sans and other_sans to CAGW subject variables and SANs using
+// the mapping of the profile, and adds them to the ones already requested.
+// Like the PKI engine the common name is also added as a SAN, if it is a
+// hostname or an email address the profile accepts as a SAN, unless
+// exclude_cn_from_sans is set.
+func processPKIFields(data *framework.FieldData, configProfile *CAGWConfigProfile, subjectVars []SubjectVariable, altNames []SubjectAltName) ([]SubjectVariable, []SubjectAltName, error) {
+	commonName := data.Get("common_name").(string)
+	if len(commonName) > 0 {
+		cnVariable := configProfile.commonNameVariable()
+		for _, v := range subjectVars {
+			if strings.EqualFold(v.Type, cnVariable) {
+				return nil, nil, fmt.Errorf("common_name cannot be combined with %s in subject_variables", cnVariable)
+			}
+		}
+		subjectVars = append(subjectVars, SubjectVariable{Type: cnVariable, Value: commonName})
+
+		if !data.Get("exclude_cn_from_sans").(bool) && !containsAltName(altNames, commonName) {
+			if sanType, ok := configProfile.commonNameSANType(commonName); ok {
+				altNames = append(altNames, SubjectAltName{Type: sanType, Value: commonName})
+			}
+		}
+	}
+
+	for _, ip := range data.Get("ip_sans").([]string) {
+		if net.ParseIP(ip) == nil {
+			return nil, nil, fmt.Errorf("invalid IP address in ip_sans: %s", ip)
+		}
+		altNames = append(altNames, SubjectAltName{Type: configProfile.sanType(sanKindIP), Value: ip})
+	}
+
+	for _, uri := range data.Get("uri_sans").([]string) {
+		if _, err := url.Parse(uri); err != nil {
+			return nil, nil, fmt.Errorf("invalid URI in uri_sans: %s", uri)
+		}
+		altNames = append(altNames, SubjectAltName{Type: configProfile.sanType(sanKindURI), Value: uri})
+	}
+
+	// Other SANs keep the PKI engine notation <oid>;<type>:<value>
+	for _, other := range data.Get("other_sans").([]string) {
+		if !strings.Contains(other, ";") || !strings.Contains(other, ":") {
+			return nil, nil, fmt.Errorf("invalid other SAN, expected <oid>;<type>:<value>: %s", other)
+		}
+		altNames = append(altNames, SubjectAltName{Type: configProfile.sanType(sanKindOther), Value: other})
+	}
+
+	return subjectVars, altNames, nil
+}
+
+// isHostname tells whether a name is a DNS hostname, optionally with a
+// leading wildcard label. Underscores are accepted as they are common in
+// service names.
+func isHostname(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func containsAltName(altNames []SubjectAltName, value string) bool {
+	for _, a := range altNames {
+		if a.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// rdnNames are the names of the subject attributes that can be taken from a
+// CSR, keyed by OID.
+var rdnNames = map[string]string{
+	"2.5.4.3":                    "cn",
+	"2.5.4.4":                    "sn",
+	"2.5.4.5":                    "serialNumber",
+	"2.5.4.6":                    "c",
+	"2.5.4.7":                    "l",
+	"2.5.4.8":                    "st",
+	"2.5.4.9":                    "street",
+	"2.5.4.10":                   "o",
+	"2.5.4.11":                   "ou",
+	"2.5.4.12":                   "title",
+	"2.5.4.17":                   "postalCode",
+	"2.5.4.42":                   "givenName",
+	"1.2.840.113549.1.9.1":       "e",
+	"0.9.2342.19200300.100.1.1":  "uid",
+	"0.9.2342.19200300.100.1.25": "dc",
+}
+
+// processCSRValues maps the subject attributes of the CSR onto the subject
+// variables of the profile and its SANs onto the SAN types of the profile.
+// Subject variables requested explicitly take precedence over all CSR values
+// of the same type; otherwise every value of a repeated attribute, such as
+// several OU or DC values, is copied. Attributes and SANs the profile has no
+// requirement for are returned as unmapped.
+func processCSRValues(csr *x509.CertificateRequest, configProfile *CAGWConfigProfile, subjectVars []SubjectVariable, altNames []SubjectAltName) ([]SubjectVariable, []SubjectAltName, []string) {
+	unmapped := []string{}
+	requested := subjectVars
+
+	for _, attr := range csr.Subject.Names {
+		oid := attr.Type.String()
+		value := fmt.Sprint(attr.Value)
+
+		rdnName, ok := rdnNames[oid]
+		if !ok {
+			rdnName = oid
+		}
+		name, ok := configProfile.subjectVariableName(rdnName)
+		if !ok {
+			unmapped = append(unmapped, fmt.Sprintf("subject %s=%s", rdnName, value))
+			continue
+		}
+		if containsSubjectVariable(requested, name) {
+			continue
+		}
+		subjectVars = append(subjectVars, SubjectVariable{Type: name, Value: value})
+	}
+
+	addSAN := func(kind string, value string) {
+		sanType := configProfile.sanType(kind)
+		if !configProfile.sanTypeRequested(sanType) {
+			unmapped = append(unmapped, fmt.Sprintf("%s SAN %s", kind, value))
+			return
+		}
+		if containsAltName(altNames, value) {
+			return
+		}
+		altNames = append(altNames, SubjectAltName{Type: sanType, Value: value})
+	}
+	for _, name := range csr.DNSNames {
+		addSAN(sanKindDNS, name)
+	}
+	for _, email := range csr.EmailAddresses {
+		addSAN(sanKindEmail, email)
+	}
+	for _, ip := range csr.IPAddresses {
+		addSAN(sanKindIP, ip.String())
+	}
+	for _, uri := range csr.URIs {
+		addSAN(sanKindURI, uri.String())
+	}
+
+	return subjectVars, altNames, unmapped
+}
+
+func containsAltNameType(altNames []SubjectAltName, sanType string) bool {
+	for _, a := range altNames {
+		if strings.EqualFold(a.Type, sanType) {
+			return true
+		}
+	}
+	return false
+}
+
+// requirementsErrorResponse reports all requirement violations of a request
+// at once.
+func requirementsErrorResponse(violations []string) *logical.Response {
+	resp := logical.ErrorResponse("Request does not meet the requirements of the profile: " + strings.Join(violations, "; "))
+	resp.Data["errors"] = violations
+	return resp
+}
+
+func containsSubjectVariable(subjectVars []SubjectVariable, name string) bool {
+	for _, v := range subjectVars {
+		if strings.EqualFold(v.Type, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2020 Entrust Datacard Corporation.
+ * All rights reserved.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"reflect"
+	"testing"
+)
+
+func TestProcessCSRValues(t *testing.T) {
+	profile := CAGWConfigProfile{
+		SubjectVariableRequirements: []SubjectVariableRequirement{{Name: "cn"}, {Name: "ou"}, {Name: "dc"}},
+		SubjectAltNameRequirements:  []SubjectAltNameRequirement{{Type: "dNSName"}},
+	}
+	csr := &x509.CertificateRequest{
+		Subject: pkix.Name{Names: []pkix.AttributeTypeAndValue{
+			{Type: asn1.ObjectIdentifier{2, 5, 4, 3}, Value: "www.example.com"},
+			{Type: asn1.ObjectIdentifier{2, 5, 4, 11}, Value: "a"},
+			{Type: asn1.ObjectIdentifier{2, 5, 4, 11}, Value: "b"},
+			{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 25}, Value: "example"},
+			{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 25}, Value: "com"},
+			{Type: asn1.ObjectIdentifier{2, 5, 4, 10}, Value: "Example"},
+		}},
+		DNSNames:       []string{"www.example.com"},
+		EmailAddresses: []string{"admin@example.com"},
+	}
+
+	tests := []struct {
+		name        string
+		subjectVars []SubjectVariable
+		want        []SubjectVariable
+	}{
+		{
+			name: "repeated attributes are all copied",
+			want: []SubjectVariable{
+				{Type: "cn", Value: "www.example.com"},
+				{Type: "ou", Value: "a"},
+				{Type: "ou", Value: "b"},
+				{Type: "dc", Value: "example"},
+				{Type: "dc", Value: "com"},
+			},
+		},
+		{
+			name:        "requested variables take precedence over every CSR value",
+			subjectVars: []SubjectVariable{{Type: "OU", Value: "c"}},
+			want: []SubjectVariable{
+				{Type: "OU", Value: "c"},
+				{Type: "cn", Value: "www.example.com"},
+				{Type: "dc", Value: "example"},
+				{Type: "dc", Value: "com"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subjectVars, altNames, unmapped := processCSRValues(csr, &profile, tt.subjectVars, nil)
+			if !reflect.DeepEqual(subjectVars, tt.want) {
+				t.Errorf("subject variables = %v, want %v", subjectVars, tt.want)
+			}
+			if want := []SubjectAltName{{Type: "dNSName", Value: "www.example.com"}}; !reflect.DeepEqual(altNames, want) {
+				t.Errorf("alt names = %v, want %v", altNames, want)
+			}
+			if want := []string{"subject o=Example", "email SAN admin@example.com"}; !reflect.DeepEqual(unmapped, want) {
+				t.Errorf("unmapped = %q, want %q", unmapped, want)
+			}
+		})
+	}
+}